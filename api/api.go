@@ -16,6 +16,7 @@ import (
 
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/andrexus/cloud-initer/conf"
 	"github.com/andrexus/cloud-initer/embedded"
@@ -35,7 +36,31 @@ type API struct {
 	// Services used by the API
 	instances   model.InstanceService
 	environment model.EnvironmentService
-	cloudInit model.CloudInitService
+	cloudInit   model.CloudInitService
+	tokens      model.TokenService
+	events      model.EventService
+	fetches     model.FetchService
+	audit       model.AuditService
+	bundles     model.BundleService
+
+	// directory is nil unless the configuration is read from a directory
+	directory *model.DirectorySource
+
+	// resolveBy holds the allowed ways to match guests to instances
+	resolveBy map[model.ResolvedBy]bool
+	// done stops the background jobs, closed once by Stop
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// jwt is nil unless JWT authentication is configured
+	jwt *jwtAuthenticator
+	// tls is nil when serving plain HTTP
+	tls *tlsReloader
+
+	// metadata serves the guest-facing routes when they are separated
+	// from the management API, nil otherwise
+	metadata    *echo.Echo
+	metadataTLS *tlsReloader
 
 	validator CustomValidator
 }
@@ -74,6 +99,8 @@ func NewAPIResponseFromValidationError(errors validator.ValidationErrors) *Messa
 			message = fmt.Sprintf("%s is wrong", err.Field())
 		case "mac":
 			message = fmt.Sprintf("%s is wrong", err.Field())
+		case "deliveryPolicy":
+			message = "delivery policy is invalid"
 		}
 		if strings.HasPrefix(err.Tag(), "unique") {
 			message = fmt.Sprintf("%s '%s' already exists", err.Field(), err.Value())
@@ -92,31 +119,136 @@ func (cv *CustomValidator) Validate(i interface{}) error {
 	return cv.validator.Struct(i)
 }
 
-// Start will start the API on the specified port
+// Start will start the API on the specified host and port, and the
+// metadata datasource on its own address when configured. It returns
+// when the first of them stops.
 func (api *API) Start() error {
-	return api.echo.Start(fmt.Sprintf(":%d", api.config.API.Port))
+	go api.housekeeping()
+	if api.config.Backup.Dir != "" {
+		go api.scheduledBackups()
+	}
+	if api.directory != nil {
+		go func() {
+			if err := api.directory.Watch(api.done); err != nil {
+				api.log.WithError(err).Error("Failed to watch the configuration directory")
+			}
+		}()
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- startServer(api.echo, api.config.API.Host, api.config.API.Port, api.tls)
+	}()
+	if api.metadata != nil {
+		go func() {
+			errs <- startServer(api.metadata, api.config.Metadata.Host, api.config.Metadata.Port, api.metadataTLS)
+		}()
+	}
+	return <-errs
+}
+
+func startServer(e *echo.Echo, host string, port int, reloader *tlsReloader) error {
+	address := fmt.Sprintf("%s:%d", host, port)
+	if reloader == nil {
+		return e.Start(address)
+	}
+	s := e.TLSServer
+	s.Addr = address
+	s.TLSConfig = reloader.TLSConfig()
+	return e.StartServer(s)
+}
+
+// housekeeping drops fetches and trashed instances beyond their
+// retention once an hour
+func (api *API) housekeeping() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := api.fetches.Prune(); err != nil {
+			api.log.WithError(err).Error("Failed to prune fetches")
+		}
+		retention := time.Duration(api.config.Trash.RetentionDays) * 24 * time.Hour
+		purged, err := api.instances.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			api.log.WithError(err).Error("Failed to purge trash")
+		} else if purged > 0 {
+			api.log.Infof("Purged %d instances from the trash", purged)
+		}
+		select {
+		case <-ticker.C:
+		case <-api.done:
+			return
+		}
+	}
 }
 
 // Stop will shutdown the engine internally
 func (api *API) Stop() error {
 	logrus.Info("Stopping API server")
+	api.stopOnce.Do(func() { close(api.done) })
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	return api.echo.Shutdown(ctx)
+	// both listeners are stopped, the first error is returned
+	var err error
+	if api.metadata != nil {
+		err = api.metadata.Shutdown(ctx)
+	}
+	if shutdownErr := api.echo.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
 }
 
 // NewAPI will create an api instance that is ready to start
-func NewAPI(config *conf.Config, db *bolt.DB) *API {
+func NewAPI(config *conf.Config, db *bolt.DB, storage *model.Storage) (*API, error) {
 	api := &API{
-		config: config,
-		log:    logrus.WithField("component", "api"),
-		db:     db,
+		config:    config,
+		log:       logrus.WithField("component", "api"),
+		db:        db,
+		resolveBy: make(map[model.ResolvedBy]bool),
+		done:      make(chan struct{}),
+	}
+	for _, method := range config.Metadata.ResolveBy {
+		api.resolveBy[model.ResolvedBy(method)] = true
 	}
 
 	apiValidator := createValidator()
-	api.environment = model.NewEnvironmentService(model.NewEnvironmentRepository(db), apiValidator.validator)
-	api.instances = model.NewInstanceService(model.NewInstanceRepository(db), apiValidator.validator)
+	api.audit = model.NewAuditService(model.NewAuditRepository(db), config.Audit.File)
+	environments, instances := storage.Environment, storage.Instances
+	if config.GitOps.Dir != "" {
+		var err error
+		if api.directory, err = model.NewDirectorySource(config.GitOps.Dir); err != nil {
+			return nil, err
+		}
+		environments = model.NewDirEnvironmentRepository(api.directory)
+		instances = model.NewDirInstanceRepository(api.directory)
+	}
+	api.environment = model.NewEnvironmentService(environments, api.audit, apiValidator.validator)
+	api.instances = model.NewInstanceService(instances, api.audit, apiValidator.validator)
 	api.cloudInit = model.NewCloudInitService(api.instances, api.environment)
+	api.bundles = model.NewBundleService(api.instances, api.environment)
+	api.tokens = model.NewTokenService(model.NewTokenRepository(db))
+	api.events = model.NewEventService(model.NewEventRepository(db), api.instances, config.Events.MaxPerInstance)
+	retention := time.Duration(config.Fetches.RetentionDays) * 24 * time.Hour
+	api.fetches = model.NewFetchService(model.NewFetchRepository(db), retention)
+
+	if config.API.JWT.Enabled() {
+		var err error
+		if api.jwt, err = newJWTAuthenticator(&config.API.JWT); err != nil {
+			return nil, err
+		}
+	}
+	if config.API.TLS.Enabled() {
+		var err error
+		if api.tls, err = newTLSReloader(&config.API.TLS); err != nil {
+			return nil, err
+		}
+	}
+	if config.Metadata.Enabled() && config.Metadata.TLS.Enabled() {
+		var err error
+		if api.metadataTLS, err = newTLSReloader(&config.Metadata.TLS); err != nil {
+			return nil, err
+		}
+	}
 
 	// add the endpoints
 	e := echo.New()
@@ -124,29 +256,110 @@ func NewAPI(config *conf.Config, db *bolt.DB) *API {
 	e.Validator = apiValidator
 	//e.Use(api.logRequest)
 
-	g := e.Group("/api/v1")
+	// management API, guests only need the metadata routes below
+	management := []echo.MiddlewareFunc{api.authenticate}
+	if config.API.TLS.ClientCAFile != "" {
+		management = append([]echo.MiddlewareFunc{requireClientCert}, management...)
+	}
+	g := e.Group("/api/v1", management...)
+
+	readInstances := api.authorize(model.PermissionReadInstances)
+	writeInstances := api.authorize(model.PermissionWriteInstances)
+	editEnvironment := api.authorize(model.PermissionEditEnvironment)
+	// the configuration can't be changed when it's read from a directory,
+	// the runtime state of the instances can
+	configureInstances := []echo.MiddlewareFunc{writeInstances}
+	configureEnvironment := []echo.MiddlewareFunc{editEnvironment}
+	if api.directory != nil {
+		configureInstances = append(configureInstances, readOnly)
+		configureEnvironment = append(configureEnvironment, readOnly)
+	}
 
 	// Instances
-	g.GET("/instances", api.InstanceList)
-	g.POST("/instances", api.InstanceCreate)
-	g.GET("/instances/:id", api.InstanceGet)
-	g.PUT("/instances/:id", api.InstanceUpdate)
-	g.DELETE("/instances/:id", api.InstanceDelete)
+	g.GET("/instances", api.InstanceList, readInstances)
+	g.POST("/instances", api.InstanceCreate, configureInstances...)
+	g.DELETE("/instances", api.InstanceBulkDelete, configureInstances...)
+	g.POST("/instances/arm", api.InstanceBulkArm, writeInstances)
+	g.POST("/instances:method", api.InstanceMethod, configureInstances...)
+	g.GET("/instances/:id", api.InstanceGet, readInstances)
+	g.PUT("/instances/:id", api.InstanceUpdate, configureInstances...)
+	g.PATCH("/instances/:id", api.InstancePatch, configureInstances...)
+	g.DELETE("/instances/:id", api.InstanceDelete, configureInstances...)
+	g.POST("/instances/:id/arm", api.InstanceArm, writeInstances)
+	g.POST("/instances/:id/status", api.InstanceTransition, writeInstances)
+	g.GET("/instances/:id/events", api.InstanceEvents, readInstances)
+	g.GET("/instances/:id/fetches", api.InstanceFetches, readInstances)
+	g.GET("/instances/:id/revisions", api.InstanceRevisions, readInstances)
+	g.GET("/instances/:id/revisions/:rev", api.InstanceRevisionGet, readInstances)
+	g.GET("/instances/:id/revisions/:rev/diff", api.InstanceRevisionDiff, readInstances)
+	g.POST("/instances/:id/revisions/:rev/restore", api.InstanceRevisionRestore, configureInstances...)
+
+	// Trash
+	g.GET("/trash", api.TrashList, readInstances)
+	g.POST("/trash/:id/restore", api.TrashRestore, configureInstances...)
+	g.DELETE("/trash/:id", api.TrashPurge, configureInstances...)
+
+	g.GET("/known_hosts", api.KnownHosts, readInstances)
+
+	// Environment, secrets are redacted unless the principal may reveal them
+	g.GET("/environment", api.EnvironmentGet, readInstances)
+	g.PUT("/environment", api.EnvironmentUpdate, configureEnvironment...)
+	g.GET("/environment/revisions", api.EnvironmentRevisions, readInstances)
+	g.GET("/environment/revisions/:rev", api.EnvironmentRevisionGet, readInstances)
+	g.GET("/environment/revisions/:rev/diff", api.EnvironmentRevisionDiff, readInstances)
+	g.POST("/environment/revisions/:rev/restore", api.EnvironmentRevisionRestore, configureEnvironment...)
+
+	// the bundle holds the environment with its secrets
+	g.GET("/export", api.Export, editEnvironment)
+	g.POST("/export", api.Import, configureEnvironment...)
+	if api.directory != nil {
+		g.GET("/directory", api.DirectoryStatus, readInstances)
+	}
+
+	// Tokens
+	manageTokens := api.authorize(model.PermissionManageTokens)
+	g.GET("/tokens", api.TokenList, manageTokens)
+	g.POST("/tokens", api.TokenCreate, manageTokens)
+	g.DELETE("/tokens/:id", api.TokenRevoke, manageTokens)
 
-	// Environment
-	g.GET("/environment", api.EnvironmentGet)
-	g.PUT("/environment", api.EnvironmentUpdate)
+	g.GET("/audit", api.AuditList, api.authorize(model.PermissionReadAudit))
+
+	g.GET("/admin/backup", api.Backup, api.authorize(model.PermissionBackup))
 
 	// cloud-init
-	g.POST("/preview", api.Preview)
-	e.GET("/user-data", api.UserData, api.logRequest, api.injectInstanceByIp)
-	e.GET("/meta-data", api.MetaData, api.logRequest, api.injectInstanceByIp)
+	g.POST("/preview", api.Preview, api.authorize(model.PermissionRevealSecrets))
+
+	// a separate metadata listener gets nothing but the guest routes,
+	// so guests can't reach the management API through it
+	if config.Metadata.Enabled() {
+		m := echo.New()
+		m.HideBanner = true
+		m.Use(api.logRequest)
+		api.addMetadataRoutes(m)
+		api.metadata = m
+	} else {
+		api.addMetadataRoutes(e, api.logRequest)
+	}
 
 	e.GET("/*", api.serveVirtualFS, api.frontend404Fallback)
 
 	api.echo = e
 
-	return api
+	return api, nil
+}
+
+// addMetadataRoutes registers the routes cloud-init fetches its
+// datasource from
+func (api *API) addMetadataRoutes(e *echo.Echo, m ...echo.MiddlewareFunc) {
+	e.GET("/user-data", api.UserData, m...)
+	e.GET("/meta-data", api.MetaData, m...)
+	e.GET("/nocloud/:key/user-data", api.UserData, m...)
+	e.GET("/nocloud/:key/meta-data", api.MetaData, m...)
+	e.POST("/status", api.ReportStatus, m...)
+	e.POST("/phone-home", api.PhoneHome, m...)
+	e.POST("/phone-home/:id", api.PhoneHome, m...)
+	e.POST("/reporting", api.Reporting, m...)
+	e.POST("/reporting/:id", api.Reporting, m...)
 }
 
 func createValidator() *CustomValidator {
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/boltdb/bolt"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAPI serves the API from a fresh Bolt database
+func newTestAPI(t *testing.T) (*API, func()) {
+	dir, err := ioutil.TempDir("", "cloud-initer")
+	assert.Nil(t, err)
+	db, err := bolt.Open(filepath.Join(dir, "test.bolt"), 0600, nil)
+	assert.Nil(t, err)
+	_, err = model.Migrate(db, false)
+	assert.Nil(t, err)
+	storage, err := model.OpenStorage(model.DefaultStorageDriver, db, "")
+	assert.Nil(t, err)
+
+	config := new(conf.Config)
+	config.Metadata.ResolveBy = []string{"ip"}
+	config.Events.MaxPerInstance = 500
+	config.Fetches.RetentionDays = 30
+	api, err := NewAPI(config, db, storage)
+	assert.Nil(t, err)
+	return api, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testToken creates a token and returns its secret
+func testToken(t *testing.T, api *API, role model.Role, scope map[string]string) string {
+	_, secret, err := api.tokens.Create(&model.Token{Name: string(role), Role: role, Scope: scope}, 0)
+	assert.Nil(t, err)
+	return secret
+}
+
+// serve answers a request, headers are given as name and value pairs
+func serve(api *API, method, path, token, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	api.echo.ServeHTTP(rec, req)
+	return rec
+}
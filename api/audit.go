@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+// defaultAuditLimit caps the entries returned without a limit parameter
+const defaultAuditLimit = 100
+
+// AuditList returns the audit entries, newest first, filtered by the
+// actor, action, resource, resourceId, since and until (RFC 3339)
+// query parameters
+func (api *API) AuditList(ctx echo.Context) error {
+	filter := &model.AuditFilter{
+		Actor:      ctx.QueryParam("actor"),
+		Action:     model.AuditAction(ctx.QueryParam("action")),
+		Resource:   ctx.QueryParam("resource"),
+		ResourceID: ctx.QueryParam("resourceId"),
+		Limit:      defaultAuditLimit,
+	}
+	var err error
+	if v := ctx.QueryParam("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return badQueryParam(ctx, "since", err)
+		}
+	}
+	if v := ctx.QueryParam("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return badQueryParam(ctx, "until", err)
+		}
+	}
+	if v := ctx.QueryParam("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return badQueryParam(ctx, "limit", err)
+		}
+	}
+
+	items, err := api.audit.Find(filter)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+func badQueryParam(ctx echo.Context, name string, err error) error {
+	message := "invalid " + name
+	if err != nil {
+		message += ": " + err.Error()
+	}
+	response := &MessageResponse{Status: enums.Error, Message: message}
+	return ctx.JSON(http.StatusBadRequest, response)
+}
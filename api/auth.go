@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+const principalKey = "request.principal"
+
+// authenticate rejects requests that don't carry a valid API token or,
+// when configured, a JWT in the Authorization header
+func (api *API) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		secret := bearerToken(ctx.Request())
+
+		// API tokens never contain dots, JWTs always do
+		if api.jwt != nil && strings.Count(secret, ".") == 2 {
+			principal, err := api.jwt.Authenticate(secret)
+			if err != nil {
+				getLogger(ctx).WithError(err).Info("Rejected JWT")
+				return unauthorized(ctx, "invalid token")
+			}
+			ctx.Set(principalKey, principal)
+			return next(ctx)
+		}
+
+		token, err := api.tokens.Authenticate(secret)
+		if err != nil {
+			if err == model.ErrTokenInvalid || err == model.ErrTokenExpired {
+				return unauthorized(ctx, err.Error())
+			}
+			response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+			return ctx.JSON(http.StatusInternalServerError, response)
+		}
+
+		ctx.Set(principalKey, token.Principal())
+		return next(ctx)
+	}
+}
+
+// authorize rejects requests from principals lacking the permission.
+// It must run after authenticate.
+func (api *API) authorize(permission model.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !getPrincipal(ctx).Can(permission) {
+				return forbidden(ctx, fmt.Sprintf("permission denied: %s", permission))
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func getPrincipal(ctx echo.Context) *model.Principal {
+	obj := ctx.Get(principalKey)
+	if obj == nil {
+		// never grant anything to unauthenticated requests
+		return &model.Principal{}
+	}
+	return obj.(*model.Principal)
+}
+
+func unauthorized(ctx echo.Context, message string) error {
+	ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="cloud-initer"`)
+	response := &MessageResponse{Status: enums.Error, Message: message}
+	return ctx.JSON(http.StatusUnauthorized, response)
+}
+
+func forbidden(ctx echo.Context, message string) error {
+	response := &MessageResponse{Status: enums.Error, Message: message}
+	return ctx.JSON(http.StatusForbidden, response)
+}
+
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get(echo.HeaderAuthorization)
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// getActor returns who is making the request, for the audit log
+func getActor(ctx echo.Context) *model.Actor {
+	return &model.Actor{Name: getPrincipal(ctx).Name, SourceIP: ctx.RealIP()}
+}
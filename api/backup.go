@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+// Backup streams a consistent copy of the database. It holds the tokens
+// and the environment with its secrets.
+func (api *API) Backup(ctx echo.Context) error {
+	if len(getPrincipal(ctx).Scope) > 0 {
+		return forbidden(ctx, "the database can't be backed up with a scoped token")
+	}
+	if err := model.CheckBackupDriver(api.config.DB.Driver); err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusNotImplemented, response)
+	}
+	res := ctx.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", model.BackupName(time.Now())))
+	return model.WriteBackup(api.db, res, func(size int64) {
+		res.Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+		res.WriteHeader(http.StatusOK)
+	})
+}
+
+// scheduledBackups copies the database to the backup directory every
+// interval and drops the oldest copies beyond the ones to keep
+func (api *API) scheduledBackups() {
+	interval := time.Duration(api.config.Backup.IntervalHours) * time.Hour
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-api.done:
+			return
+		}
+		path := filepath.Join(api.config.Backup.Dir, model.BackupName(time.Now()))
+		if err := model.BackupToFile(api.db, path); err != nil {
+			api.log.WithError(err).Error("Failed to back up the database")
+			continue
+		}
+		api.log.Infof("Backed up the database to %s", path)
+		removed, err := model.RotateBackups(api.config.Backup.Dir, api.config.Backup.Keep)
+		if err != nil {
+			api.log.WithError(err).Error("Failed to remove old backups")
+		}
+		for _, path := range removed {
+			api.log.Infof("Removed old backup %s", path)
+		}
+	}
+}
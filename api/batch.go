@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// BatchMode tells whether a batch is applied all-or-nothing or as far
+// as possible
+type BatchMode string
+
+const (
+	BatchAtomic     BatchMode = "atomic"
+	BatchBestEffort BatchMode = "best-effort"
+)
+
+type BatchRequest struct {
+	// Mode defaults to atomic
+	Mode BatchMode `json:"mode"`
+	// DryRun validates the batch without storing it
+	DryRun     bool                   `json:"dryRun"`
+	Operations []model.BatchOperation `json:"operations"`
+}
+
+type BatchResponse struct {
+	Applied   int                   `json:"applied"`
+	Failed    int                   `json:"failed"`
+	Committed bool                  `json:"committed"`
+	Results   []BatchResultResponse `json:"results"`
+}
+
+// BatchResultResponse is the outcome of a single operation, with the
+// status code it would have gotten on its own
+type BatchResultResponse struct {
+	Index    int              `json:"index"`
+	Op       model.BatchOp    `json:"op"`
+	ID       string           `json:"id,omitempty"`
+	Status   int              `json:"status"`
+	Instance *model.Instance  `json:"instance,omitempty"`
+	Error    *MessageResponse `json:"error,omitempty"`
+}
+
+// InstanceMethod serves the custom methods on the instance collection,
+// /instances:<method>. Echo takes the colon for a path parameter.
+func (api *API) InstanceMethod(ctx echo.Context) error {
+	if ctx.Param("method") == ":batch" {
+		return api.InstanceBatch(ctx)
+	}
+	return echo.ErrNotFound
+}
+
+// InstanceBatch creates, updates and deletes instances in a single
+// transaction
+func (api *API) InstanceBatch(ctx echo.Context) error {
+	req := new(BatchRequest)
+	if err := ctx.Bind(req); err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	if req.Mode == "" {
+		req.Mode = BatchAtomic
+	}
+	if req.Mode != BatchAtomic && req.Mode != BatchBestEffort {
+		message := fmt.Sprintf("unknown mode '%s', expected %s or %s", req.Mode, BatchAtomic, BatchBestEffort)
+		response := &MessageResponse{Status: enums.Error, Message: message}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	if len(req.Operations) > model.MaxBatchOperations {
+		message := fmt.Sprintf("a batch is limited to %d operations", model.MaxBatchOperations)
+		response := &MessageResponse{Status: enums.Error, Message: message}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+
+	options := model.BatchOptions{Atomic: req.Mode == BatchAtomic, DryRun: req.DryRun}
+	results, err := api.instances.Batch(req.Operations, options, getPrincipal(ctx), getActor(ctx))
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &BatchResponse{Results: []BatchResultResponse{}}
+	for _, result := range results {
+		item := BatchResultResponse{
+			Index:    result.Index,
+			Op:       result.Op,
+			ID:       result.ID,
+			Status:   batchStatus(&result),
+			Instance: result.Instance,
+		}
+		switch err := result.Err.(type) {
+		case nil:
+			response.Applied++
+		case validator.ValidationErrors:
+			item.Error = NewAPIResponseFromValidationError(err)
+			response.Failed++
+		default:
+			item.Error = &MessageResponse{Status: enums.Error, Message: err.Error()}
+			if err != model.ErrBatchRolledBack {
+				response.Failed++
+			}
+		}
+		response.Results = append(response.Results, item)
+	}
+	response.Committed = !req.DryRun && (req.Mode == BatchBestEffort || response.Failed == 0)
+	if req.Mode == BatchAtomic && response.Failed > 0 {
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+func batchStatus(result *model.BatchResult) int {
+	switch result.Err {
+	case nil:
+		if result.Op == model.BatchCreate {
+			return http.StatusCreated
+		}
+		return http.StatusOK
+	case model.ErrInstanceNotFound:
+		return http.StatusNotFound
+	case model.ErrOutOfScope:
+		return http.StatusForbidden
+	case model.ErrRevisionConflict:
+		return http.StatusConflict
+	case model.ErrBatchRolledBack:
+		return http.StatusFailedDependency
+	}
+	return http.StatusBadRequest
+}
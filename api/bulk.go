@@ -0,0 +1,86 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+)
+
+// selectorParam parses the selector query parameter. Label parameters
+// (key=value) are added as equality requirements.
+func selectorParam(ctx echo.Context) (model.Selector, error) {
+	selector, err := model.ParseSelector(ctx.QueryParam("selector"))
+	if err != nil {
+		return nil, err
+	}
+	labels, err := model.ParseLabels(ctx.QueryParams()["label"])
+	if err != nil {
+		return nil, err
+	}
+	return append(selector, model.SelectorFromLabels(labels)...), nil
+}
+
+// selectInstances responds with an error and returns false unless the
+// request has a selector. It returns the selected instances within the
+// principal's scope.
+func (api *API) selectInstances(ctx echo.Context) ([]model.Instance, bool, error) {
+	selector, err := selectorParam(ctx)
+	if err == nil && selector.Empty() {
+		err = errors.New("a selector is required")
+	}
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return nil, false, ctx.JSON(http.StatusBadRequest, response)
+	}
+	items, _, err := api.instances.FindPage(&model.InstanceQuery{
+		Selector: selector,
+		Scope:    getPrincipal(ctx).Scope,
+	})
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return nil, false, ctx.JSON(http.StatusInternalServerError, response)
+	}
+	return items, true, nil
+}
+
+// InstanceBulkArm arms all instances matching the selector
+func (api *API) InstanceBulkArm(ctx echo.Context) error {
+	items, ok, err := api.selectInstances(ctx)
+	if !ok {
+		return err
+	}
+	armed := []model.Instance{}
+	for _, item := range items {
+		updated, err := api.instances.Arm(item.ID.Hex(), getActor(ctx))
+		if err != nil {
+			message := fmt.Sprintf("arming %s failed after %d instances: %s", item.Name, len(armed), err)
+			response := &MessageResponse{Status: enums.Error, Message: message}
+			return ctx.JSON(http.StatusInternalServerError, response)
+		}
+		armed = append(armed, *updated)
+	}
+	response := &ListResponse{Page: 1, PageSize: len(armed), Total: len(armed), Items: armed}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// InstanceBulkDelete moves all instances matching the selector to the
+// trash
+func (api *API) InstanceBulkDelete(ctx echo.Context) error {
+	items, ok, err := api.selectInstances(ctx)
+	if !ok {
+		return err
+	}
+	for i, item := range items {
+		if err := api.instances.Delete(item.ID.Hex(), 0, getActor(ctx)); err != nil {
+			message := fmt.Sprintf("deleting %s failed after %d instances: %s", item.Name, i, err)
+			response := &MessageResponse{Status: enums.Error, Message: message}
+			return ctx.JSON(http.StatusInternalServerError, response)
+		}
+	}
+	response := &MessageResponse{Message: fmt.Sprintf("%d instances deleted", len(items))}
+	return ctx.JSON(http.StatusOK, response)
+}
@@ -1,22 +1,47 @@
 package api
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/andrexus/cloud-initer/enums"
 	"github.com/andrexus/cloud-initer/model"
 	"github.com/labstack/echo"
 )
 
-const instanceKey = "request.instance"
+// PreviewRequest holds the templates to render, for the instance with
+// InstanceID when given
+type PreviewRequest struct {
+	UserData   string `json:"userData"`
+	MetaData   string `json:"metaData"`
+	InstanceID string `json:"instanceId"`
+}
 
 func (api *API) Preview(ctx echo.Context) error {
-	data := new(model.CloudInitData)
+	data := new(PreviewRequest)
 	if err := ctx.Bind(data); err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
-	result, err := api.cloudInit.PreviewCloudInitData(data.UserData, data.MetaData)
+	var item *model.Instance
+	if data.InstanceID != "" {
+		var err error
+		if item, err = api.instances.FindOne(data.InstanceID); err != nil {
+			response := &MessageResponse{Message: err.Error()}
+			return ctx.JSON(http.StatusInternalServerError, response)
+		}
+		if item == nil {
+			response := &MessageResponse{Status: enums.Error, Message: model.ErrInstanceNotFound.Error()}
+			return ctx.JSON(http.StatusNotFound, response)
+		}
+		if !getPrincipal(ctx).CanAccess(item) {
+			return forbidden(ctx, errOutOfScope)
+		}
+	}
+	result, err := api.cloudInit.PreviewCloudInitData(data.UserData, data.MetaData, item)
 	if err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
@@ -26,29 +51,117 @@ func (api *API) Preview(ctx echo.Context) error {
 }
 
 func (api *API) UserData(ctx echo.Context) error {
-	item := ctx.Get(instanceKey).(*model.CloudInitData)
-	return ctx.String(http.StatusOK, item.UserData)
+	return api.serveDocument(ctx, model.DocumentUserData)
 }
 
 func (api *API) MetaData(ctx echo.Context) error {
-	item := ctx.Get(instanceKey).(*model.CloudInitData)
-	return ctx.String(http.StatusOK, item.MetaData)
+	return api.serveDocument(ctx, model.DocumentMetaData)
 }
 
-func (api *API) injectInstanceByIp(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		ip := ctx.RealIP()
-		cloudInitData, e := api.cloudInit.GetCloudInitDataForClient(ip, ctx.Request().UserAgent())
-		if e != nil {
-			response := &MessageResponse{Status: enums.Error, Message: e.Error()}
-			return ctx.JSON(http.StatusInternalServerError, response)
+// serveDocument renders a document for the guest making the request and
+// adds the request to the instance's fetch log
+func (api *API) serveDocument(ctx echo.Context, document model.Document) error {
+	client := &model.Client{
+		IPAddress: ctx.RealIP(),
+		UserAgent: ctx.Request().UserAgent(),
+		Key:       ctx.Param("key"),
+	}
+	resolvedBy := client.ResolvedBy()
+	logger := getLogger(ctx).WithFields(logrus.Fields{
+		"document":    document,
+		"ip_address":  client.IPAddress,
+		"resolved_by": resolvedBy,
+	})
+	if !api.resolveBy[resolvedBy] {
+		logger.WithField("status", http.StatusForbidden).Info("Fetch")
+		response := &MessageResponse{Status: enums.Error, Message: fmt.Sprintf("resolving instances by %s is disabled", resolvedBy)}
+		return ctx.JSON(http.StatusForbidden, response)
+	}
+
+	item, content, err := api.cloudInit.GetDocumentForClient(client, document)
+	status := http.StatusOK
+	switch err {
+	case nil:
+	case model.ErrInstanceNotFound:
+		status = http.StatusNotFound
+	case model.ErrDeliveryDenied:
+		status = http.StatusForbidden
+	default:
+		status = http.StatusInternalServerError
+	}
+	logger.WithField("status", status).Info("Fetch")
+
+	if item != nil {
+		fetch := &model.Fetch{
+			SourceIP:   client.IPAddress,
+			UserAgent:  client.UserAgent,
+			ResolvedBy: resolvedBy,
+			Document:   document,
+			Status:     status,
 		}
+		if err == nil {
+			fetch.ContentHash = fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		}
+		if err := api.fetches.Record(item.ID.Hex(), fetch); err != nil {
+			logger.WithError(err).Error("Failed to record fetch")
+		}
+	}
 
-		ctx.Set(instanceKey, cloudInitData)
-		err := next(ctx)
-		if err != nil {
-			ctx.Error(err)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(status, response)
+	}
+	return ctx.String(status, content)
+}
+
+// ReportStatus lets guests report their provisioning progress, e.g.
+// from a runcmd: curl -d status=booted http://<datasource>/status
+func (api *API) ReportStatus(ctx echo.Context) error {
+	req := new(StatusRequest)
+	if err := ctx.Bind(req); err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	item, err := api.instances.ReportStatusForClient(ctx.RealIP(), req.Status)
+	if err != nil {
+		return transitionError(ctx, err)
+	}
+	response := &MessageResponse{Message: string(item.Status)}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// PhoneHome receives the POST of cloud-init's phone_home module:
+//
+//	phone_home:
+//	  url: http://<datasource>/phone-home/$INSTANCE_ID
+//	  post: all
+func (api *API) PhoneHome(ctx echo.Context) error {
+	form, err := ctx.FormParams()
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	report := &model.PhoneHomeReport{
+		InstanceID: form.Get("instance_id"),
+		Hostname:   form.Get("hostname"),
+		FQDN:       form.Get("fqdn"),
+		HostKeys:   make(map[string]string),
+	}
+	for name := range form {
+		if strings.HasPrefix(name, "pub_key_") {
+			report.HostKeys[strings.TrimPrefix(name, "pub_key_")] = form.Get(name)
+		}
+	}
+
+	item, err := api.instances.PhoneHome(ctx.RealIP(), ctx.Param("id"), report)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		if err == model.ErrInstanceNotFound {
+			return ctx.JSON(http.StatusNotFound, response)
 		}
-		return err
+		return ctx.JSON(http.StatusBadRequest, response)
 	}
+	getLogger(ctx).WithField("instance", item.ID.Hex()).Info("Phone home")
+	response := &MessageResponse{Message: string(item.Status)}
+	return ctx.JSON(http.StatusOK, response)
 }
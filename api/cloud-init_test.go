@@ -0,0 +1,64 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// cloud-init posts the instance-id of the meta-data, which has nothing
+// to do with the ID of the instance here
+func TestPhoneHome(t *testing.T) {
+	api, cleanup := newTestAPI(t)
+	defer cleanup()
+	token := testToken(t, api, model.RoleOperator, nil)
+	// httptest requests come from 192.0.2.1
+	rec := serve(api, http.MethodPost, "/api/v1/instances", token,
+		`{"name": "web1", "ipAddress": "192.0.2.1", "macAddress": "00:00:00:00:00:01", "metaData": "instance-id: iid-local01"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var item model.Instance
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &item))
+
+	// the guest boots before it phones home
+	for _, path := range []string{"/meta-data", "/user-data"} {
+		rec = serve(api, http.MethodGet, path, "", "")
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+	}
+	rec = serve(api, http.MethodPost, "/status", "", `{"status": "booted"}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	form := url.Values{
+		"instance_id":     {"iid-local01"},
+		"hostname":        {"web1"},
+		"fqdn":            {"web1.example.com"},
+		"pub_key_ed25519": {string(ssh.MarshalAuthorizedKey(key))},
+		"pub_key_rsa":     {""},
+	}
+	rec = serve(api, http.MethodPost, "/phone-home/iid-local01", "", form.Encode(),
+		"Content-Type", echo.MIMEApplicationForm)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	found, err := api.instances.FindOne(item.ID.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, string(model.StatusFinished), string(found.Status))
+	assert.Equal(t, "iid-local01", found.ReportedInstanceID)
+	assert.Equal(t, "web1.example.com", found.ReportedFQDN)
+	assert.Len(t, found.SSHHostKeys, 1)
+
+	// other callers aren't taken for the instance
+	rec = serve(api, http.MethodPost, "/phone-home/iid-local01", "", form.Encode(),
+		"Content-Type", echo.MIMEApplicationForm, "X-Real-IP", "192.0.2.2")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
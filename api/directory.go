@@ -0,0 +1,24 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+// DirectoryStatus tells which state of the configuration directory is
+// served and why the last change failed to load
+func (api *API) DirectoryStatus(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, api.directory.Status())
+}
+
+// readOnly rejects changes to the configuration while it's read from a
+// directory
+func readOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		response := &MessageResponse{Status: enums.Error, Message: model.ErrReadOnly.Error()}
+		return ctx.JSON(http.StatusForbidden, response)
+	}
+}
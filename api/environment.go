@@ -15,6 +15,14 @@ func (api *API) EnvironmentGet(ctx echo.Context) error {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
+	if !getPrincipal(ctx).Can(model.PermissionRevealSecrets) {
+		item, err = item.Redacted()
+		if err != nil {
+			response := &MessageResponse{Message: err.Error()}
+			return ctx.JSON(http.StatusInternalServerError, response)
+		}
+	}
+	setETag(ctx, item.Revision)
 	return ctx.JSON(http.StatusOK, item)
 
 }
@@ -28,11 +36,27 @@ func (api *API) EnvironmentUpdate(ctx echo.Context) error {
 	if err := ctx.Validate(item); err != nil {
 		return ctx.JSON(http.StatusBadRequest, NewAPIResponseFromValidationError(err.(validator.ValidationErrors)))
 	}
-	item, err := api.environment.Update(item)
+	// a revision in the body is checked as well, the header wins
+	if hasIfMatch(ctx) {
+		current, err := api.environment.GetEnvironment()
+		if err != nil {
+			response := &MessageResponse{Message: err.Error()}
+			return ctx.JSON(http.StatusInternalServerError, response)
+		}
+		if !ifMatch(ctx, current.Revision) {
+			return preconditionFailed(ctx)
+		}
+		item.Revision = current.Revision
+	}
+	item, err := api.environment.Update(item, getActor(ctx))
+	if err == model.ErrRevisionConflict {
+		return revisionConflict(ctx)
+	}
 	if err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
+	setETag(ctx, item.Revision)
 	return ctx.JSON(http.StatusOK, item)
 
 }
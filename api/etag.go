@@ -0,0 +1,75 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+const (
+	headerETag    = "ETag"
+	headerIfMatch = "If-Match"
+)
+
+// ETags are the revision of the resource, runtime state like the status
+// of an instance doesn't change them
+func revisionETag(revision uint64) string {
+	return fmt.Sprintf(`"%d"`, revision)
+}
+
+func setETag(ctx echo.Context, revision uint64) {
+	ctx.Response().Header().Set(headerETag, revisionETag(revision))
+}
+
+// hasIfMatch reports whether the request is conditional
+func hasIfMatch(ctx echo.Context) bool {
+	return ctx.Request().Header.Get(headerIfMatch) != ""
+}
+
+// ifMatch evaluates the If-Match header against the current revision
+func ifMatch(ctx echo.Context, revision uint64) bool {
+	for _, tag := range strings.Split(ctx.Request().Header.Get(headerIfMatch), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == revisionETag(revision) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInstanceIfMatch responds with 412 and returns false when the
+// If-Match header doesn't match the stored instance. Otherwise it
+// returns the revision a change has to replace, 0 without the header.
+func (api *API) checkInstanceIfMatch(ctx echo.Context, id string) (uint64, bool, error) {
+	if !hasIfMatch(ctx) {
+		return 0, true, nil
+	}
+	item, err := api.instances.FindOne(id)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return 0, false, ctx.JSON(http.StatusInternalServerError, response)
+	}
+	if item == nil || !ifMatch(ctx, item.Revision) {
+		return 0, false, preconditionFailed(ctx)
+	}
+	return item.Revision, true, nil
+}
+
+func preconditionFailed(ctx echo.Context) error {
+	response := &MessageResponse{Status: enums.Error, Message: model.ErrRevisionConflict.Error()}
+	return ctx.JSON(http.StatusPreconditionFailed, response)
+}
+
+// revisionConflict responds to ErrRevisionConflict, with 412 when the
+// request was conditional and 409 when the revision came in the body
+func revisionConflict(ctx echo.Context) error {
+	if hasIfMatch(ctx) {
+		return preconditionFailed(ctx)
+	}
+	response := &MessageResponse{Status: enums.Error, Message: model.ErrRevisionConflict.Error()}
+	return ctx.JSON(http.StatusConflict, response)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+// ReportingEvent is the JSON posted by cloud-init's webhook reporter
+type ReportingEvent struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	EventType   string  `json:"event_type"`
+	Origin      string  `json:"origin"`
+	Result      string  `json:"result"`
+	Timestamp   float64 `json:"timestamp"`
+}
+
+// Reporting receives events from cloud-init's webhook reporter:
+//
+//	reporting:
+//	  cloud-initer:
+//	    type: webhook
+//	    endpoint: http://<datasource>/reporting
+func (api *API) Reporting(ctx echo.Context) error {
+	req := new(ReportingEvent)
+	if err := ctx.Bind(req); err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	sec, frac := math.Modf(req.Timestamp)
+	event := &model.Event{
+		Name:        req.Name,
+		Description: req.Description,
+		EventType:   req.EventType,
+		Origin:      req.Origin,
+		Result:      req.Result,
+		Timestamp:   time.Unix(int64(sec), int64(frac*1e9)),
+	}
+
+	_, err := api.events.RecordForClient(ctx.RealIP(), ctx.Param("id"), event)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		switch err {
+		case model.ErrInstanceNotFound:
+			return ctx.JSON(http.StatusNotFound, response)
+		case model.ErrInstanceMismatch:
+			return ctx.JSON(http.StatusForbidden, response)
+		}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+func (api *API) InstanceEvents(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	items, err := api.events.FindByInstance(id)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+func (api *API) InstanceFetches(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	items, err := api.fetches.FindByInstance(id)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+const errScopedBundle = "the whole configuration can't be exported or imported with a scoped token"
+
+// ImportChangeResponse is a change of an import along with the reason
+// it can't be made
+type ImportChangeResponse struct {
+	model.ImportChange
+	Error *MessageResponse `json:"error,omitempty"`
+}
+
+type ImportResponse struct {
+	DryRun  bool                   `json:"dryRun"`
+	Applied bool                   `json:"applied"`
+	Changes []ImportChangeResponse `json:"changes"`
+}
+
+// Export serves the configuration as a bundle, YAML unless format=json
+// is given
+func (api *API) Export(ctx echo.Context) error {
+	if len(getPrincipal(ctx).Scope) > 0 {
+		return forbidden(ctx, errScopedBundle)
+	}
+	format := model.BundleFormat(ctx.QueryParam("format"))
+	if format == "" {
+		format = model.BundleYAML
+	}
+	if format != model.BundleYAML && format != model.BundleJSON {
+		return badQueryParam(ctx, "format", errors.Errorf("expected %s or %s", model.BundleYAML, model.BundleJSON))
+	}
+	bundle, err := api.bundles.Export()
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	content, err := bundle.Encode(format)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	contentType := "application/x-yaml"
+	if format == model.BundleJSON {
+		contentType = echo.MIMEApplicationJSONCharsetUTF8
+	}
+	return ctx.Blob(http.StatusOK, contentType, content)
+}
+
+// Import makes the configuration match the bundle in the body, YAML or
+// JSON. Query parameters:
+//
+//	dryRun       report the changes without making them
+//	prune        delete the instances that aren't in the bundle
+//	preserveIds  create new instances with the IDs from the bundle
+func (api *API) Import(ctx echo.Context) error {
+	if len(getPrincipal(ctx).Scope) > 0 {
+		return forbidden(ctx, errScopedBundle)
+	}
+	var options model.ImportOptions
+	flags := map[string]*bool{
+		"dryRun":      &options.DryRun,
+		"prune":       &options.Prune,
+		"preserveIds": &options.PreserveIDs,
+	}
+	for name, flag := range flags {
+		v := ctx.QueryParam(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *flag, err = strconv.ParseBool(v); err != nil {
+			return badQueryParam(ctx, name, err)
+		}
+	}
+
+	body, err := ioutil.ReadAll(ctx.Request().Body)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	bundle, err := model.DecodeBundle(body)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: errors.Wrap(err, "invalid bundle").Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	result, err := api.bundles.Import(bundle, options, getActor(ctx))
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+
+	response := &ImportResponse{DryRun: result.DryRun, Applied: result.Applied, Changes: []ImportChangeResponse{}}
+	for _, change := range result.Changes {
+		item := ImportChangeResponse{ImportChange: change}
+		switch err := change.Err.(type) {
+		case nil:
+		case validator.ValidationErrors:
+			item.Error = NewAPIResponseFromValidationError(err)
+		default:
+			item.Error = &MessageResponse{Status: enums.Error, Message: err.Error()}
+		}
+		response.Changes = append(response.Changes, item)
+	}
+	if len(result.Failed()) > 0 {
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	return ctx.JSON(http.StatusOK, response)
+}
@@ -1,39 +1,115 @@
 package api
 
 import (
+	"net"
 	"net/http"
+	"strconv"
 
+	"github.com/andrexus/cloud-initer/enums"
 	"github.com/andrexus/cloud-initer/model"
 	"github.com/labstack/echo"
+	"github.com/pkg/errors"
 	"gopkg.in/go-playground/validator.v9"
+	"gopkg.in/mgo.v2/bson"
 )
 
+var errOutOfScope = model.ErrOutOfScope.Error()
+
+// InstanceList returns a page of instances. Query parameters:
+//
+//	page, pageSize  pagination, all instances without pageSize
+//	sort            name, ipAddress, createdAt or requestedAt, "-" for descending
+//	name            name prefix
+//	cidr            network the IP address is in
+//	mac             MAC address
+//	selector        label selector, e.g. role in (web,api),dc!=ams1
+//	label           key=value, repeatable
+//	status          provisioning status
+//	neverRequested  true for instances that never fetched a document
 func (api *API) InstanceList(ctx echo.Context) error {
-	var err error
+	query, err := parseInstanceQuery(ctx)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	query.Scope = getPrincipal(ctx).Scope
 
-	items, err := api.instances.FindAll()
+	items, total, err := api.instances.FindPage(query)
 	if err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
-	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	pageSize := query.PageSize
+	if pageSize == 0 {
+		pageSize = total
+	}
+	response := &ListResponse{Page: query.Page, PageSize: pageSize, Total: total, Items: items}
 	return ctx.JSON(http.StatusOK, response)
 }
 
+func parseInstanceQuery(ctx echo.Context) (*model.InstanceQuery, error) {
+	query := &model.InstanceQuery{
+		Page:       1,
+		NamePrefix: ctx.QueryParam("name"),
+		MACAddress: ctx.QueryParam("mac"),
+		Status:     model.InstanceStatus(ctx.QueryParam("status")),
+	}
+	var err error
+	if v := ctx.QueryParam("page"); v != "" {
+		if query.Page, err = strconv.Atoi(v); err != nil || query.Page < 1 {
+			return nil, errors.Errorf("invalid page '%s'", v)
+		}
+	}
+	if v := ctx.QueryParam("pageSize"); v != "" {
+		if query.PageSize, err = strconv.Atoi(v); err != nil || query.PageSize < 1 {
+			return nil, errors.Errorf("invalid pageSize '%s'", v)
+		}
+	}
+	if query.Sort, query.Descending, err = model.ParseInstanceSort(ctx.QueryParam("sort")); err != nil {
+		return nil, err
+	}
+	if v := ctx.QueryParam("cidr"); v != "" {
+		if _, query.Network, err = net.ParseCIDR(v); err != nil {
+			return nil, errors.Errorf("invalid cidr '%s'", v)
+		}
+	}
+	if query.MACAddress != "" {
+		if _, err := net.ParseMAC(query.MACAddress); err != nil {
+			return nil, errors.Errorf("invalid mac '%s'", query.MACAddress)
+		}
+	}
+	if query.Status != "" && !query.Status.Valid() {
+		return nil, errors.Errorf("unknown status '%s'", query.Status)
+	}
+	if query.Selector, err = selectorParam(ctx); err != nil {
+		return nil, err
+	}
+	if v := ctx.QueryParam("neverRequested"); v != "" {
+		if query.NeverRequested, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.Errorf("invalid neverRequested '%s'", v)
+		}
+	}
+	return query, nil
+}
+
 func (api *API) InstanceCreate(ctx echo.Context) error {
 	item := new(model.Instance)
 	if err := ctx.Bind(item); err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
+	if !getPrincipal(ctx).CanAccess(item) {
+		return forbidden(ctx, errOutOfScope)
+	}
 	if err := ctx.Validate(item); err != nil {
 		return ctx.JSON(http.StatusBadRequest, NewAPIResponseFromValidationError(err.(validator.ValidationErrors)))
 	}
-	item, err := api.instances.Create(item)
+	item, err := api.instances.Create(item, getActor(ctx))
 	if err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
+	setETag(ctx, item.Revision)
 	return ctx.JSON(http.StatusCreated, item)
 
 }
@@ -50,32 +126,126 @@ func (api *API) InstanceGet(ctx echo.Context) error {
 		response := &MessageResponse{Message: "instance not found"}
 		return ctx.JSON(http.StatusNotFound, response)
 	}
+	if !getPrincipal(ctx).CanAccess(item) {
+		return forbidden(ctx, errOutOfScope)
+	}
+	setETag(ctx, item.Revision)
 	return ctx.JSON(http.StatusOK, item)
 
 }
 
 func (api *API) InstanceUpdate(ctx echo.Context) error {
 	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	revision, ok, err := api.checkInstanceIfMatch(ctx, id)
+	if !ok {
+		return err
+	}
 	newItem := new(model.Instance)
 	if err := ctx.Bind(newItem); err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
+	// a revision in the body is checked as well, the header wins
+	if hasIfMatch(ctx) {
+		newItem.Revision = revision
+	}
+	return api.updateInstance(ctx, id, newItem)
+}
+
+// updateInstance validates and saves the new configuration of an
+// instance, as sent with a PUT or patched
+func (api *API) updateInstance(ctx echo.Context, id string, newItem *model.Instance) error {
+	if !getPrincipal(ctx).CanAccess(newItem) {
+		return forbidden(ctx, errOutOfScope)
+	}
+	// the uniqueness checks must not match the instance itself
+	if bson.IsObjectIdHex(id) {
+		newItem.ID = bson.ObjectIdHex(id)
+	}
 	if err := ctx.Validate(newItem); err != nil {
 		return ctx.JSON(http.StatusBadRequest, NewAPIResponseFromValidationError(err.(validator.ValidationErrors)))
 	}
-	item, err := api.instances.Update(id, newItem)
+	item, err := api.instances.Update(id, newItem, getActor(ctx))
+	if err == model.ErrRevisionConflict {
+		return revisionConflict(ctx)
+	}
 	if err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
 	}
+	setETag(ctx, item.Revision)
 	return ctx.JSON(http.StatusOK, item)
 
 }
 
+// InstanceArm opens the provisioning window of the instance and lets it
+// fetch its user-data again
+func (api *API) InstanceArm(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	item, err := api.instances.Arm(id, getActor(ctx))
+	if err == model.ErrInstanceNotFound {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusNotFound, response)
+	}
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	return ctx.JSON(http.StatusOK, item)
+}
+
+type StatusRequest struct {
+	Status model.InstanceStatus `json:"status" form:"status"`
+}
+
+// InstanceTransition moves the instance to the requested status
+func (api *API) InstanceTransition(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	req := new(StatusRequest)
+	if err := ctx.Bind(req); err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	item, err := api.instances.Transition(id, req.Status, getActor(ctx))
+	if err != nil {
+		return transitionError(ctx, err)
+	}
+	return ctx.JSON(http.StatusOK, item)
+}
+
+func transitionError(ctx echo.Context, err error) error {
+	response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+	switch errors.Cause(err) {
+	case model.ErrInstanceNotFound:
+		return ctx.JSON(http.StatusNotFound, response)
+	case model.ErrIllegalTransition:
+		return ctx.JSON(http.StatusConflict, response)
+	}
+	return ctx.JSON(http.StatusBadRequest, response)
+}
+
 func (api *API) InstanceDelete(ctx echo.Context) error {
 	id := ctx.Param("id")
-	err := api.instances.Delete(id)
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	revision, ok, err := api.checkInstanceIfMatch(ctx, id)
+	if !ok {
+		return err
+	}
+	err = api.instances.Delete(id, revision, getActor(ctx))
+	if err == model.ErrRevisionConflict {
+		return revisionConflict(ctx)
+	}
 	if err != nil {
 		response := &MessageResponse{Message: err.Error()}
 		return ctx.JSON(http.StatusInternalServerError, response)
@@ -83,3 +253,18 @@ func (api *API) InstanceDelete(ctx echo.Context) error {
 	response := &MessageResponse{Message: "instance deleted"}
 	return ctx.JSON(http.StatusOK, response)
 }
+
+// checkInstanceScope responds with an error and returns false when the
+// stored instance is not accessible to the principal. Missing instances
+// are left to the handler.
+func (api *API) checkInstanceScope(ctx echo.Context, id string) (bool, error) {
+	item, err := api.instances.FindOne(id)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return false, ctx.JSON(http.StatusInternalServerError, response)
+	}
+	if item != nil && !getPrincipal(ctx).CanAccess(item) {
+		return false, forbidden(ctx, errOutOfScope)
+	}
+	return true, nil
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// jwksMaxAge is how long fetched keys are used before refetching
+	jwksMaxAge = time.Hour
+	// jwksMinInterval limits refetches caused by unknown key IDs
+	jwksMinInterval = time.Minute
+)
+
+// only asymmetric algorithms, the verification key is public
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// roles ordered by privilege, the highest matching role wins
+var jwtRoleOrder = []model.Role{model.RoleAdmin, model.RoleOperator, model.RoleViewer}
+
+// jwtAuthenticator verifies bearer JWTs issued by an identity provider
+type jwtAuthenticator struct {
+	config *conf.JWTConfig
+	log    *logrus.Entry
+	client *http.Client
+	parser *jwt.Parser
+
+	mu        sync.Mutex
+	staticKey interface{}
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	// attemptedAt is the last fetch, failed or not, to back off from
+	attemptedAt time.Time
+	// refreshing is closed when the running fetch is done, nil if none runs
+	refreshing chan struct{}
+	refreshErr error
+}
+
+func newJWTAuthenticator(config *conf.JWTConfig) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{
+		config: config,
+		log:    logrus.WithField("component", "jwt"),
+		client: &http.Client{Timeout: 10 * time.Second},
+		parser: &jwt.Parser{ValidMethods: jwtMethods},
+	}
+	if config.KeyFile != "" {
+		data, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading JWT key file")
+		}
+		if a.staticKey, err = parsePublicKey(data); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", config.KeyFile)
+		}
+	}
+	if config.JWKSFile != "" {
+		// fail early on a broken file, remote key sets are fetched lazily
+		if err := a.refreshKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Authenticate verifies the token and maps its claims to a principal
+func (a *jwtAuthenticator) Authenticate(raw string) (*model.Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(raw, claims, a.key); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, errors.New("token has no expiry or is expired")
+	}
+	if !claims.VerifyIssuer(a.config.Issuer, true) {
+		return nil, errors.New("token issuer mismatch")
+	}
+	if !containsClaimValue(claims["aud"], a.config.Audience) {
+		return nil, errors.New("token audience mismatch")
+	}
+
+	name, _ := claims[a.config.NameClaim].(string)
+	principal := &model.Principal{Name: name}
+	granted := map[model.Role]bool{}
+	for _, value := range claimValues(claims[a.config.RolesClaim]) {
+		role := model.Role(value)
+		if len(a.config.Roles) > 0 {
+			role = model.Role(a.config.Roles[value])
+		}
+		granted[role] = true
+	}
+	for _, role := range jwtRoleOrder {
+		if granted[role] {
+			principal.Role = role
+			break
+		}
+	}
+	return principal, nil
+}
+
+func (a *jwtAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	if a.staticKey != nil {
+		return a.staticKey, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetchedAt) > jwksMaxAge
+	// the provider may have rotated its keys, failed fetches are retried
+	// no sooner than successful ones
+	if (stale || !ok) && a.refreshing == nil && time.Since(a.attemptedAt) > jwksMinInterval {
+		a.attemptedAt = time.Now()
+		a.refreshing = make(chan struct{})
+		go a.refresh(a.refreshing)
+	}
+	refreshing := a.refreshing
+	a.mu.Unlock()
+	if ok {
+		// keep using the cached key while the keys are fetched
+		return key, nil
+	}
+
+	if refreshing != nil {
+		<-refreshing
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok = a.keys[kid]; ok {
+		return key, nil
+	}
+	if a.refreshErr != nil {
+		return nil, a.refreshErr
+	}
+	return nil, errors.Errorf("unknown signing key '%s'", kid)
+}
+
+// refresh fetches the keys without holding the lock, only one fetch runs
+// at a time
+func (a *jwtAuthenticator) refresh(done chan struct{}) {
+	defer close(done)
+	keys, err := a.loadKeys()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refreshing = nil
+	a.refreshErr = err
+	if err != nil {
+		a.log.WithError(err).Warn("Failed to refresh JWKS")
+		return
+	}
+	a.keys = keys
+	a.fetchedAt = time.Now()
+}
+
+func (a *jwtAuthenticator) refreshKeys() error {
+	keys, err := a.loadKeys()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	a.attemptedAt = a.fetchedAt
+	return nil
+}
+
+func (a *jwtAuthenticator) loadKeys() (map[string]interface{}, error) {
+	var data []byte
+	var err error
+	if a.config.JWKSFile != "" {
+		data, err = ioutil.ReadFile(a.config.JWKSFile)
+	} else {
+		data, err = a.fetchJWKS()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "loading JWKS")
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing JWKS")
+	}
+	return keys, nil
+}
+
+func (a *jwtAuthenticator) fetchJWKS() ([]byte, error) {
+	resp, err := a.client.Get(a.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the RSA and EC signing keys of a JWK set by key ID
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, errors.Wrapf(err, "key '%s'", k.Kid)
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return nil, errors.Wrapf(err, "key '%s'", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, errors.Errorf("key '%s': unsupported curve '%s'", k.Kid, k.Crv)
+			}
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, errors.Wrapf(err, "key '%s'", k.Kid)
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, errors.Wrapf(err, "key '%s'", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parsePublicKey accepts a PEM encoded public key or certificate
+func parsePublicKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// claimValues returns a string or list of strings claim as a slice
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsClaimValue(claim interface{}, value string) bool {
+	for _, v := range claimValues(claim) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
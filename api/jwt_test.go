@@ -0,0 +1,205 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func marshalJWKS(t *testing.T, kid string, key *rsa.PublicKey) []byte {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	content, err := json.Marshal(jwks)
+	assert.Nil(t, err)
+	return content
+}
+
+func writeJWKS(t *testing.T, kid string, key *rsa.PublicKey) string {
+	content := marshalJWKS(t, kid, key)
+	tmpfile, err := ioutil.TempFile("", "cloud-initer-jwks")
+	assert.Nil(t, err)
+	_, err = tmpfile.Write(content)
+	assert.Nil(t, err)
+	tmpfile.Close()
+	return tmpfile.Name()
+}
+
+func signJWT(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return signed
+}
+
+func TestJWTAuthenticatorWithJWKSFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	fname := writeJWKS(t, "test-key", &key.PublicKey)
+	defer os.Remove(fname)
+
+	config := &conf.JWTConfig{
+		JWKSFile:   fname,
+		Issuer:     "https://idp.example.com",
+		Audience:   "cloud-initer",
+		NameClaim:  "sub",
+		RolesClaim: "groups",
+		Roles:      map[string]string{"infra": "operator", "infra-admins": "admin"},
+	}
+	authenticator, err := newJWTAuthenticator(config)
+	assert.Nil(t, err)
+
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":    "alice",
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"cloud-initer", "other"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"staff", "infra"},
+		}
+	}
+
+	principal, err := authenticator.Authenticate(signJWT(t, "test-key", key, claims()))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", principal.Name)
+	assert.Equal(t, model.RoleOperator, principal.Role)
+
+	admin := claims()
+	admin["groups"] = []string{"infra", "infra-admins"}
+	principal, err = authenticator.Authenticate(signJWT(t, "test-key", key, admin))
+	assert.Nil(t, err)
+	assert.Equal(t, model.RoleAdmin, principal.Role)
+
+	unmapped := claims()
+	unmapped["groups"] = "staff"
+	principal, err = authenticator.Authenticate(signJWT(t, "test-key", key, unmapped))
+	assert.Nil(t, err)
+	assert.False(t, principal.Can(model.PermissionReadInstances))
+
+	expired := claims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = authenticator.Authenticate(signJWT(t, "test-key", key, expired))
+	assert.NotNil(t, err)
+
+	noExpiry := claims()
+	delete(noExpiry, "exp")
+	_, err = authenticator.Authenticate(signJWT(t, "test-key", key, noExpiry))
+	assert.NotNil(t, err)
+
+	wrongAudience := claims()
+	wrongAudience["aud"] = "other"
+	_, err = authenticator.Authenticate(signJWT(t, "test-key", key, wrongAudience))
+	assert.NotNil(t, err)
+
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://evil.example.com"
+	_, err = authenticator.Authenticate(signJWT(t, "test-key", key, wrongIssuer))
+	assert.NotNil(t, err)
+
+	_, err = authenticator.Authenticate(signJWT(t, "test-key", otherKey, claims()))
+	assert.NotNil(t, err)
+
+	_, err = authenticator.Authenticate(signJWT(t, "unknown-key", key, claims()))
+	assert.NotNil(t, err)
+
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	hmac.Header["kid"] = "test-key"
+	signed, err := hmac.SignedString([]byte("secret"))
+	assert.Nil(t, err)
+	_, err = authenticator.Authenticate(signed)
+	assert.NotNil(t, err)
+}
+
+func TestJWTAuthenticatorWithJWKSURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	content := marshalJWKS(t, "test-key", &key.PublicKey)
+
+	// the first fetch fails, the third one hangs until block is closed
+	var fetches int32
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&fetches, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case 3:
+			<-block
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	authenticator, err := newJWTAuthenticator(&conf.JWTConfig{
+		JWKSURL:   server.URL,
+		Issuer:    "https://idp.example.com",
+		Audience:  "cloud-initer",
+		NameClaim: "sub",
+	})
+	assert.Nil(t, err)
+	token := signJWT(t, "test-key", key, jwt.MapClaims{
+		"sub": "alice",
+		"iss": "https://idp.example.com",
+		"aud": "cloud-initer",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	// a failed fetch backs off like a successful one
+	_, err = authenticator.Authenticate(token)
+	assert.NotNil(t, err)
+	_, err = authenticator.Authenticate(token)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	authenticator.mu.Lock()
+	authenticator.attemptedAt = time.Now().Add(-2 * jwksMinInterval)
+	authenticator.mu.Unlock()
+	_, err = authenticator.Authenticate(token)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// stale keys are served while they're refetched
+	authenticator.mu.Lock()
+	authenticator.fetchedAt = time.Now().Add(-2 * jwksMaxAge)
+	authenticator.attemptedAt = authenticator.fetchedAt
+	authenticator.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		_, err = authenticator.Authenticate(token)
+		assert.Nil(t, err)
+	}
+	close(block)
+	authenticator.mu.Lock()
+	refreshing := authenticator.refreshing
+	authenticator.mu.Unlock()
+	if refreshing != nil {
+		<-refreshing
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+	authenticator.mu.Lock()
+	assert.True(t, time.Since(authenticator.fetchedAt) < jwksMinInterval)
+	authenticator.mu.Unlock()
+}
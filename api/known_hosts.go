@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+// KnownHosts serves an OpenSSH known_hosts file for all instances that
+// reported their host keys. Pass hashed=true to hash the host names and
+// a selector to limit the instances.
+func (api *API) KnownHosts(ctx echo.Context) error {
+	selector, err := selectorParam(ctx)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	items, _, err := api.instances.FindPage(&model.InstanceQuery{
+		Sort:     model.SortByName,
+		Selector: selector,
+		Scope:    getPrincipal(ctx).Scope,
+	})
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	content, err := model.KnownHosts(items, ctx.QueryParam("hashed") == "true")
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	return ctx.Blob(http.StatusOK, echo.MIMETextPlainCharsetUTF8, content)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/labstack/echo"
+)
+
+const (
+	mimeMergePatch = "application/merge-patch+json"
+	mimeJSONPatch  = "application/json-patch+json"
+)
+
+// InstancePatch changes an instance with a JSON merge patch (RFC 7386)
+// or a JSON patch (RFC 6902), told apart by the content type. The
+// patched instance is validated and saved like with a PUT.
+func (api *API) InstancePatch(ctx echo.Context) error {
+	id := ctx.Param("id")
+	item, err := api.instances.FindOne(id)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	if item == nil {
+		response := &MessageResponse{Status: enums.Error, Message: model.ErrInstanceNotFound.Error()}
+		return ctx.JSON(http.StatusNotFound, response)
+	}
+	if !getPrincipal(ctx).CanAccess(item) {
+		return forbidden(ctx, errOutOfScope)
+	}
+	if hasIfMatch(ctx) && !ifMatch(ctx, item.Revision) {
+		return preconditionFailed(ctx)
+	}
+
+	patch, err := ioutil.ReadAll(ctx.Request().Body)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	doc, err := json.Marshal(item)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	mediaType, _, _ := mime.ParseMediaType(ctx.Request().Header.Get(echo.HeaderContentType))
+	switch mediaType {
+	case mimeMergePatch:
+		doc, err = jsonpatch.MergePatch(doc, patch)
+	case mimeJSONPatch:
+		doc, err = applyJSONPatch(doc, patch)
+	default:
+		response := &MessageResponse{
+			Status:  enums.Error,
+			Message: "patches have to be sent as " + mimeMergePatch + " or " + mimeJSONPatch,
+		}
+		return ctx.JSON(http.StatusUnsupportedMediaType, response)
+	}
+	// the failure is wrapped with %w, which errors.Cause doesn't unwrap
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusConflict, response)
+	}
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+
+	newItem := new(model.Instance)
+	if err := json.Unmarshal(doc, newItem); err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	// the patch applies to the revision it was made for
+	newItem.Revision = item.Revision
+	return api.updateInstance(ctx, id, newItem)
+}
+
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(doc)
+}
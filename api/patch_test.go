@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstancePatch(t *testing.T) {
+	api, cleanup := newTestAPI(t)
+	defer cleanup()
+	token := testToken(t, api, model.RoleOperator, nil)
+	rec := serve(api, http.MethodPost, "/api/v1/instances", token,
+		`{"name": "web1", "ipAddress": "10.0.0.1", "macAddress": "00:00:00:00:00:01"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var item model.Instance
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &item))
+	path := "/api/v1/instances/" + item.ID.Hex()
+
+	// a failing test operation is a conflict, not a bad request
+	rec = serve(api, http.MethodPatch, path, token,
+		`[{"op": "test", "path": "/name", "value": "web2"}, {"op": "replace", "path": "/name", "value": "web3"}]`,
+		"Content-Type", mimeJSONPatch)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serve(api, http.MethodPatch, path, token, `[{"op": "bogus"}]`, "Content-Type", mimeJSONPatch)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(api, http.MethodPatch, path, token,
+		`[{"op": "test", "path": "/name", "value": "web1"}, {"op": "replace", "path": "/name", "value": "web3"}]`,
+		"Content-Type", mimeJSONPatch)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// the patch applies to the revision named by If-Match
+	rec = serve(api, http.MethodPatch, path, token, `{"name": "web4"}`,
+		"Content-Type", mimeMergePatch, "If-Match", `"1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = serve(api, http.MethodPatch, path, token, `{"name": "web4"}`,
+		"Content-Type", mimeMergePatch, "If-Match", `"2"`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &item))
+	assert.Equal(t, "web4", item.Name)
+	assert.Equal(t, uint64(3), item.Revision)
+}
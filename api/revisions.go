@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+	"gopkg.in/go-playground/validator.v9"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (api *API) InstanceRevisions(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	items, err := api.instances.FindRevisions(id)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+func (api *API) InstanceRevisionGet(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	revision, err := revisionParam(ctx, "rev")
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	item, err := api.instances.FindRevision(id, revision)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	return ctx.JSON(http.StatusOK, item)
+}
+
+// InstanceRevisionDiff returns a unified diff from the revision given
+// by the against parameter, the previous one by default, to :rev
+func (api *API) InstanceRevisionDiff(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	revision, against, err := diffParams(ctx)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	to, err := api.instances.FindRevision(id, revision)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	var from interface{}
+	if against > 0 {
+		if from, err = api.instances.FindRevision(id, against); err != nil {
+			return revisionError(ctx, err)
+		}
+	}
+	return diffResponse(ctx, from, to)
+}
+
+// InstanceRevisionRestore saves the configuration of the revision as a
+// new revision. The runtime state of the instance is kept.
+func (api *API) InstanceRevisionRestore(ctx echo.Context) error {
+	id := ctx.Param("id")
+	if ok, err := api.checkInstanceScope(ctx, id); !ok {
+		return err
+	}
+	revision, err := revisionParam(ctx, "rev")
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	old, err := api.instances.FindRevision(id, revision)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	if !getPrincipal(ctx).CanAccess(old) {
+		return forbidden(ctx, errOutOfScope)
+	}
+	// the address may have been taken by another instance since
+	old.ID = bson.ObjectIdHex(id)
+	if err := ctx.Validate(old); err != nil {
+		return ctx.JSON(http.StatusBadRequest, NewAPIResponseFromValidationError(err.(validator.ValidationErrors)))
+	}
+	item, err := api.instances.Restore(id, revision, getActor(ctx))
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	return ctx.JSON(http.StatusOK, item)
+}
+
+func (api *API) EnvironmentRevisions(ctx echo.Context) error {
+	items, err := api.environment.FindRevisions()
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+func (api *API) EnvironmentRevisionGet(ctx echo.Context) error {
+	revision, err := revisionParam(ctx, "rev")
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	item, err := api.findEnvironmentRevision(ctx, revision)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	return ctx.JSON(http.StatusOK, item)
+}
+
+// EnvironmentRevisionDiff diffs two revisions like InstanceRevisionDiff.
+// Values are redacted on both sides unless the principal may reveal
+// secrets.
+func (api *API) EnvironmentRevisionDiff(ctx echo.Context) error {
+	revision, against, err := diffParams(ctx)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	to, err := api.findEnvironmentRevision(ctx, revision)
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	var from interface{}
+	if against > 0 {
+		if from, err = api.findEnvironmentRevision(ctx, against); err != nil {
+			return revisionError(ctx, err)
+		}
+	}
+	return diffResponse(ctx, from, to)
+}
+
+func (api *API) EnvironmentRevisionRestore(ctx echo.Context) error {
+	revision, err := revisionParam(ctx, "rev")
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	item, err := api.environment.Restore(revision, getActor(ctx))
+	if err != nil {
+		return revisionError(ctx, err)
+	}
+	return ctx.JSON(http.StatusOK, item)
+}
+
+// findEnvironmentRevision returns the revision, redacted unless the
+// principal may reveal secrets
+func (api *API) findEnvironmentRevision(ctx echo.Context, revision uint64) (*model.Environment, error) {
+	item, err := api.environment.FindRevision(revision)
+	if err != nil {
+		return nil, err
+	}
+	if !getPrincipal(ctx).Can(model.PermissionRevealSecrets) {
+		return item.Redacted()
+	}
+	return item, nil
+}
+
+func revisionParam(ctx echo.Context, name string) (uint64, error) {
+	revision, err := strconv.ParseUint(ctx.Param(name), 10, 64)
+	if err != nil || revision == 0 {
+		return 0, model.ErrRevisionNotFound
+	}
+	return revision, nil
+}
+
+// diffParams returns the revision to diff and the one to diff against,
+// 0 when diffing the first revision against nothing
+func diffParams(ctx echo.Context) (uint64, uint64, error) {
+	revision, err := revisionParam(ctx, "rev")
+	if err != nil {
+		return 0, 0, err
+	}
+	against := revision - 1
+	if v := ctx.QueryParam("against"); v != "" {
+		if against, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, 0, model.ErrRevisionNotFound
+		}
+	}
+	return revision, against, nil
+}
+
+func diffResponse(ctx echo.Context, from, to interface{}) error {
+	diff, err := model.Diff(from, to)
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	return ctx.String(http.StatusOK, diff)
+}
+
+func revisionError(ctx echo.Context, err error) error {
+	response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+	switch err {
+	case model.ErrRevisionNotFound, model.ErrInstanceNotFound:
+		return ctx.JSON(http.StatusNotFound, response)
+	}
+	return ctx.JSON(http.StatusInternalServerError, response)
+}
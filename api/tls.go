@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+)
+
+// tlsCheckInterval limits how often the files are checked for changes
+const tlsCheckInterval = 10 * time.Second
+
+// tlsReloader provides the TLS configuration for new connections from
+// the configured files and reloads them after they change, so renewed
+// certificates are picked up without a restart
+type tlsReloader struct {
+	config *conf.TLSConfig
+	log    *logrus.Entry
+
+	mu        sync.Mutex
+	tlsConfig *tls.Config
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newTLSReloader(config *conf.TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{
+		config: config,
+		log:    logrus.WithField("component", "tls"),
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the server configuration to listen with
+func (r *tlsReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) > tlsCheckInterval {
+		r.checkedAt = time.Now()
+		modTime, err := r.latestModTime()
+		if err == nil && modTime.After(r.modTime) {
+			err = r.load(modTime)
+			if err == nil {
+				r.log.Info("Reloaded TLS certificate")
+			}
+		}
+		if err != nil {
+			// keep serving the certificate we have
+			r.log.WithError(err).Warn("Failed to reload TLS certificate")
+		}
+	}
+	return r.tlsConfig, nil
+}
+
+func (r *tlsReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "loading TLS certificate")
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "loading client CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates found in %s", r.config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// guests fetching metadata have no client certificate, it's
+		// required by requireClientCert for the management API only
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	r.tlsConfig = tlsConfig
+	r.modTime = modTime
+	return nil
+}
+
+func (r *tlsReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// requireClientCert rejects requests without a verified client certificate
+func requireClientCert(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		state := ctx.Request().TLS
+		if state == nil || len(state.VerifiedChains) == 0 {
+			response := &MessageResponse{Status: enums.Error, Message: "client certificate required"}
+			return ctx.JSON(http.StatusUnauthorized, response)
+		}
+		return next(ctx)
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+)
+
+type TokenCreateRequest struct {
+	Name  string            `json:"name"`
+	Role  model.Role        `json:"role"`
+	Scope map[string]string `json:"scope"`
+	// TTL is a duration such as "720h", empty for tokens that never expire
+	TTL string `json:"ttl"`
+}
+
+// TokenCreateResponse carries the token secret, which is only ever
+// returned once
+type TokenCreateResponse struct {
+	*model.Token
+	Secret string `json:"secret"`
+}
+
+// errTokenScope rejects tokens reaching beyond the scope of their creator
+const errTokenScope = "the scope of the token has to include your scope"
+
+// TokenList lists the tokens within the principal's scope
+func (api *API) TokenList(ctx echo.Context) error {
+	all, err := api.tokens.FindAll()
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	principal := getPrincipal(ctx)
+	items := []model.Token{}
+	for _, item := range all {
+		if principal.Covers(item.Scope) {
+			items = append(items, item)
+		}
+	}
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+func (api *API) TokenCreate(ctx echo.Context) error {
+	req := new(TokenCreateRequest)
+	if err := ctx.Bind(req); err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	if !getPrincipal(ctx).Covers(req.Scope) {
+		return forbidden(ctx, errTokenScope)
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+			return ctx.JSON(http.StatusBadRequest, response)
+		}
+	}
+	item := &model.Token{Name: req.Name, Role: req.Role, Scope: req.Scope}
+	item, secret, err := api.tokens.Create(item, ttl)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	return ctx.JSON(http.StatusCreated, &TokenCreateResponse{Token: item, Secret: secret})
+}
+
+// TokenRevoke revokes a token within the principal's scope, the others
+// aren't found
+func (api *API) TokenRevoke(ctx echo.Context) error {
+	item, err := api.tokens.FindOne(ctx.Param("id"))
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	if item == nil || !getPrincipal(ctx).Covers(item.Scope) {
+		response := &MessageResponse{Message: model.ErrTokenNotFound.Error()}
+		return ctx.JSON(http.StatusNotFound, response)
+	}
+	err = api.tokens.Revoke(item.ID.Hex())
+	if err == model.ErrTokenNotFound {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusNotFound, response)
+	}
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	response := &MessageResponse{Message: "token revoked"}
+	return ctx.JSON(http.StatusOK, response)
+}
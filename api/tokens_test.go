@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokensWithinScope(t *testing.T) {
+	api, cleanup := newTestAPI(t)
+	defer cleanup()
+	admin := testToken(t, api, model.RoleAdmin, nil)
+	teamA := testToken(t, api, model.RoleAdmin, map[string]string{"team": "a"})
+	viewer := testToken(t, api, model.RoleViewer, nil)
+
+	// a scoped admin can't mint tokens reaching beyond its scope
+	for _, body := range []string{
+		`{"name": "ci", "role": "admin"}`,
+		`{"name": "ci", "role": "admin", "scope": {"team": "b"}}`,
+	} {
+		rec := serve(api, http.MethodPost, "/api/v1/tokens", teamA, body)
+		assert.Equal(t, http.StatusForbidden, rec.Code, body)
+	}
+	rec := serve(api, http.MethodPost, "/api/v1/tokens", teamA, `{"name": "ci", "role": "operator", "scope": {"team": "a", "env": "prod"}}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = serve(api, http.MethodPost, "/api/v1/tokens", viewer, `{"name": "ci", "role": "viewer"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// nor see or revoke the others
+	list := func(token string) []model.Token {
+		rec := serve(api, http.MethodGet, "/api/v1/tokens", token, "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var response struct {
+			Items []model.Token `json:"items"`
+		}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return response.Items
+	}
+	assert.Len(t, list(admin), 4)
+	scoped := list(teamA)
+	assert.Len(t, scoped, 2)
+	for _, item := range scoped {
+		assert.Equal(t, "a", item.Scope["team"])
+	}
+
+	var unscoped string
+	for _, item := range list(admin) {
+		if item.Role == model.RoleViewer {
+			unscoped = item.ID.Hex()
+		}
+	}
+	rec = serve(api, http.MethodDelete, "/api/v1/tokens/"+unscoped, teamA, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(api, http.MethodDelete, "/api/v1/tokens/"+scoped[1].ID.Hex(), teamA, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(api, http.MethodDelete, "/api/v1/tokens/"+unscoped, admin, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, list(admin), 2)
+}
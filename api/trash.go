@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/andrexus/cloud-initer/enums"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/labstack/echo"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+func (api *API) TrashList(ctx echo.Context) error {
+	selector, err := selectorParam(ctx)
+	if err != nil {
+		response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+		return ctx.JSON(http.StatusBadRequest, response)
+	}
+	items, err := api.instances.FindTrash()
+	if err != nil {
+		response := &MessageResponse{Message: err.Error()}
+		return ctx.JSON(http.StatusInternalServerError, response)
+	}
+	principal := getPrincipal(ctx)
+	visible := []model.TrashedInstance{}
+	for i := range items {
+		if principal.CanAccess(&items[i].Instance) && selector.Matches(items[i].Instance.Labels) {
+			visible = append(visible, items[i])
+		}
+	}
+	items = visible
+	response := &ListResponse{Page: 1, PageSize: len(items), Total: len(items), Items: items}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// TrashRestore moves the instance back from the trash as long as no
+// other instance took its IP or MAC address in the meantime
+func (api *API) TrashRestore(ctx echo.Context) error {
+	trashed, ok, err := api.findTrashed(ctx)
+	if !ok {
+		return err
+	}
+	item, err := api.instances.Undelete(trashed.Instance.ID.Hex(), getActor(ctx))
+	if err != nil {
+		return trashError(ctx, err)
+	}
+	setETag(ctx, item.Revision)
+	return ctx.JSON(http.StatusOK, item)
+}
+
+// TrashPurge removes the instance from the trash for good
+func (api *API) TrashPurge(ctx echo.Context) error {
+	trashed, ok, err := api.findTrashed(ctx)
+	if !ok {
+		return err
+	}
+	if err := api.instances.Purge(trashed.Instance.ID.Hex(), getActor(ctx)); err != nil {
+		return trashError(ctx, err)
+	}
+	response := &MessageResponse{Message: "instance purged"}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// findTrashed responds with an error and returns false unless the
+// instance is in the trash and accessible to the principal
+func (api *API) findTrashed(ctx echo.Context) (*model.TrashedInstance, bool, error) {
+	trashed, err := api.instances.FindTrashed(ctx.Param("id"))
+	if err != nil {
+		return nil, false, trashError(ctx, err)
+	}
+	if !getPrincipal(ctx).CanAccess(&trashed.Instance) {
+		return nil, false, forbidden(ctx, errOutOfScope)
+	}
+	return trashed, true, nil
+}
+
+func trashError(ctx echo.Context, err error) error {
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		return ctx.JSON(http.StatusBadRequest, NewAPIResponseFromValidationError(validationErrors))
+	}
+	response := &MessageResponse{Status: enums.Error, Message: err.Error()}
+	if err == model.ErrInstanceNotFound {
+		return ctx.JSON(http.StatusNotFound, response)
+	}
+	return ctx.JSON(http.StatusInternalServerError, response)
+}
@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/spf13/cobra"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+var exportCmd = cobra.Command{
+	Use:   "export",
+	Short: "Export the configuration",
+	Long: "Write the environment and the instances as a versioned bundle, e.g. to keep them in git. " +
+		"Reads the database unless --server is given to fetch it from a running server",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		format, _ := cmd.Flags().GetString("format")
+		server, _ := cmd.Flags().GetString("server")
+
+		var content []byte
+		var err error
+		if server != "" {
+			token, _ := cmd.Flags().GetString("token")
+			content, err = fetchBundle(server, token, model.BundleFormat(format))
+		} else {
+			execWithConfig(cmd, func(config *conf.Config) {
+				content, err = readBundle(config, model.BundleFormat(format))
+			})
+		}
+		if err != nil {
+			logrus.Fatalf("Error exporting: %+v", err)
+		}
+
+		if output == "" || output == "-" {
+			os.Stdout.Write(content)
+			return
+		}
+		if err := ioutil.WriteFile(output, content, 0600); err != nil {
+			logrus.Fatalf("Error writing %s: %+v", output, err)
+		}
+	},
+}
+
+var importCmd = cobra.Command{
+	Use:   "import <file>",
+	Short: "Import the configuration",
+	Long: "Make the environment and the instances match a bundle written by export, in YAML or JSON. " +
+		"Writes the database unless --server is given to import it into a running server",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		content, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			logrus.Fatalf("Error reading %s: %+v", args[0], err)
+		}
+		var options model.ImportOptions
+		options.DryRun, _ = cmd.Flags().GetBool("dry-run")
+		options.Prune, _ = cmd.Flags().GetBool("prune")
+		options.PreserveIDs, _ = cmd.Flags().GetBool("preserve-ids")
+		server, _ := cmd.Flags().GetString("server")
+
+		var report *importReport
+		if server != "" {
+			token, _ := cmd.Flags().GetString("token")
+			report, err = postBundle(server, token, content, &options)
+		} else {
+			execWithConfig(cmd, func(config *conf.Config) {
+				report, err = importBundle(config, content, &options)
+			})
+		}
+		if err != nil {
+			logrus.Fatalf("Error importing: %+v", err)
+		}
+		if !report.print(options.DryRun) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringP("output", "o", "", "File to write, stdout by default")
+	exportCmd.Flags().String("format", string(model.BundleYAML), "Bundle format: yaml or json")
+	importCmd.Flags().Bool("dry-run", false, "Show the changes without making them")
+	importCmd.Flags().Bool("prune", false, "Delete the instances that aren't in the bundle")
+	importCmd.Flags().Bool("preserve-ids", false, "Create new instances with the IDs from the bundle")
+	for _, cmd := range []*cobra.Command{&exportCmd, &importCmd} {
+		cmd.Flags().String("server", "", "URL of a running server, e.g. https://cloud-initer:8000")
+		cmd.Flags().String("token", os.Getenv("CLOUD_INITER_TOKEN"), "API token for --server")
+	}
+}
+
+func bundleService(config *conf.Config) model.BundleService {
+	_, storage, err := openStorage(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	v := validator.New()
+	environment := model.NewEnvironmentService(storage.Environment, nil, v)
+	instances := model.NewInstanceService(storage.Instances, nil, v)
+	return model.NewBundleService(instances, environment)
+}
+
+func readBundle(config *conf.Config, format model.BundleFormat) ([]byte, error) {
+	bundle, err := bundleService(config).Export()
+	if err != nil {
+		return nil, err
+	}
+	return bundle.Encode(format)
+}
+
+func fetchBundle(server, token string, format model.BundleFormat) ([]byte, error) {
+	status, body, err := apiRequest(http.MethodGet, server, token, "/api/v1/export?format="+url.QueryEscape(string(format)), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, apiError(status, body)
+	}
+	return body, nil
+}
+
+// importReport is the outcome of an import, from the database or from
+// a running server
+type importReport struct {
+	Applied bool           `json:"applied"`
+	Changes []importChange `json:"changes"`
+}
+
+type importChange struct {
+	model.ImportChange
+	Error *importError `json:"error"`
+}
+
+// importError has the shape of the API's error responses
+type importError struct {
+	Message string             `json:"message"`
+	Errors  []importFieldError `json:"errors"`
+}
+
+type importFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func importBundle(config *conf.Config, content []byte, options *model.ImportOptions) (*importReport, error) {
+	bundle, err := model.DecodeBundle(content)
+	if err != nil {
+		return nil, err
+	}
+	result, err := bundleService(config).Import(bundle, *options, nil)
+	if err != nil {
+		return nil, err
+	}
+	report := &importReport{Applied: result.Applied}
+	for _, change := range result.Changes {
+		report.Changes = append(report.Changes, importChange{ImportChange: change, Error: newImportError(change.Err)})
+	}
+	return report, nil
+}
+
+func newImportError(err error) *importError {
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return &importError{Message: err.Error()}
+	}
+	e := &importError{Message: "Field validation error"}
+	for _, fieldErr := range errs {
+		e.Errors = append(e.Errors, importFieldError{fieldErr.Field(), fmt.Sprintf("'%v' failed on the '%s' validator", fieldErr.Value(), fieldErr.Tag())})
+	}
+	return e
+}
+
+func postBundle(server, token string, content []byte, options *model.ImportOptions) (*importReport, error) {
+	path := fmt.Sprintf("/api/v1/export?dryRun=%t&prune=%t&preserveIds=%t", options.DryRun, options.Prune, options.PreserveIDs)
+	status, body, err := apiRequest(http.MethodPost, server, token, path, content, "application/x-yaml")
+	if err != nil {
+		return nil, err
+	}
+	report := new(importReport)
+	// the changes come along with failures as well
+	if (status != http.StatusOK && status != http.StatusBadRequest) || json.Unmarshal(body, report) != nil {
+		return nil, apiError(status, body)
+	}
+	return report, nil
+}
+
+// print lists the changes, with their diffs for a dry run, and reports
+// whether all of them can be made
+func (r *importReport) print(diffs bool) bool {
+	ok := true
+	for _, change := range r.Changes {
+		name := change.Resource
+		if change.Name != "" {
+			name += " " + change.Name
+		}
+		if change.ID != "" {
+			name += " (" + change.ID + ")"
+		}
+		fmt.Printf("%s %s\n", change.Action, name)
+		if diffs {
+			fmt.Print(indentLines(change.Diff, "    "))
+		}
+		if change.Error != nil {
+			ok = false
+			fmt.Printf("  error: %s\n", change.Error.Message)
+			for _, e := range change.Error.Errors {
+				fmt.Printf("    %s: %s\n", e.Field, e.Message)
+			}
+		}
+	}
+	switch {
+	case !ok:
+		fmt.Println("Nothing was imported")
+	case len(r.Changes) == 0:
+		fmt.Println("Nothing to change")
+	case !r.Applied:
+		fmt.Printf("%d changes would be made\n", len(r.Changes))
+	default:
+		fmt.Printf("%d changes made\n", len(r.Changes))
+	}
+	return ok
+}
+
+func indentLines(s, indent string) string {
+	if s == "" {
+		return ""
+	}
+	lines := strings.SplitAfter(s, "\n")
+	for i := range lines {
+		if lines[i] != "" {
+			lines[i] = indent + lines[i]
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/spf13/cobra"
+)
+
+var dbCmd = cobra.Command{
+	Use:   "db",
+	Short: "Maintain the database",
+}
+
+var dbMigrateCmd = cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate the database schema",
+	Long: "Bring the database to the schema of this version. serve does so on startup, " +
+		"--dry-run lists the migrations pending without applying them",
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		execWithConfig(cmd, func(config *conf.Config) {
+			migrate(config, dryRun)
+		})
+	},
+}
+
+var dbBackupCmd = cobra.Command{
+	Use:   "backup <file>",
+	Short: "Back up the database",
+	Long: "Write a consistent copy of the database. Reads the database unless --server is given " +
+		"to fetch a copy from a running server, which holds the database open",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		server, _ := cmd.Flags().GetString("server")
+		if server != "" {
+			token, _ := cmd.Flags().GetString("token")
+			if err := fetchBackup(server, token, args[0]); err != nil {
+				logrus.Fatalf("Error backing up: %+v", err)
+			}
+			return
+		}
+		execWithConfig(cmd, func(config *conf.Config) {
+			if err := model.CheckBackupDriver(config.DB.Driver); err != nil {
+				logrus.Fatalf("Error backing up: %v", err)
+			}
+			db, err := conf.BoltConnect(config)
+			if err != nil {
+				logrus.Fatalf("Error opening database: %+v", err)
+			}
+			if err := model.BackupToFile(db, args[0]); err != nil {
+				logrus.Fatalf("Error backing up: %+v", err)
+			}
+		})
+	},
+}
+
+var dbRestoreCmd = cobra.Command{
+	Use:   "restore <file>",
+	Short: "Restore the database from a backup",
+	Long: "Replace the database with a backup after checking it. The server must be stopped, " +
+		"the replaced database is kept with the suffix .pre-restore",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.Config) {
+			restore(config, args[0])
+		})
+	},
+}
+
+var dbCheckCmd = cobra.Command{
+	Use:   "check",
+	Short: "Check the database for inconsistencies",
+	Long: "Report undecodable records, instances sharing addresses, records of instances that no longer exist " +
+		"and index entries out of line. --repair moves bad records to the quarantine bucket and fixes the indexes. " +
+		"The server must be stopped",
+	Run: func(cmd *cobra.Command, args []string) {
+		repair, _ := cmd.Flags().GetBool("repair")
+		execWithConfig(cmd, func(config *conf.Config) {
+			check(config, repair)
+		})
+	},
+}
+
+func init() {
+	dbMigrateCmd.Flags().Bool("dry-run", false, "List the pending migrations without applying them")
+	dbBackupCmd.Flags().String("server", "", "URL of a running server, e.g. https://cloud-initer:8000")
+	dbBackupCmd.Flags().String("token", os.Getenv("CLOUD_INITER_TOKEN"), "API token for --server")
+	dbCheckCmd.Flags().Bool("repair", false, "Quarantine bad records and fix the indexes")
+	dbCmd.AddCommand(&dbMigrateCmd, &dbBackupCmd, &dbRestoreCmd, &dbCheckCmd)
+}
+
+func migrate(config *conf.Config, dryRun bool) {
+	db, err := conf.BoltConnect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	version, err := model.ReadSchemaVersion(db)
+	if err != nil {
+		logrus.Fatalf("Error reading schema version: %+v", err)
+	}
+	steps, err := model.Migrate(db, dryRun)
+	if err != nil {
+		logrus.Fatalf("Error migrating: %+v", err)
+	}
+	if len(steps) == 0 {
+		fmt.Printf("Schema is at version %d, nothing to migrate\n", version)
+		return
+	}
+	for _, step := range steps {
+		fmt.Printf("%d: %s\n", step.Version, step.Description)
+	}
+	if dryRun {
+		fmt.Printf("Schema would be migrated from version %d to %d\n", version, model.SchemaVersion())
+		return
+	}
+	fmt.Printf("Schema migrated from version %d to %d\n", version, model.SchemaVersion())
+}
+
+// fetchBackup downloads a copy of the database from a running server and
+// checks it before writing it to path
+func fetchBackup(server, token, path string) error {
+	status, body, err := apiRequest(http.MethodGet, server, token, "/api/v1/admin/backup", nil, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return apiError(status, body)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := model.ValidateBackup(f.Name()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func restore(config *conf.Config, path string) {
+	if err := model.CheckBackupDriver(config.DB.Driver); err != nil {
+		logrus.Fatalf("Error restoring: %v", err)
+	}
+	// fails while a server holds the database open
+	db, err := conf.BoltConnect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	db.Close()
+	info, err := model.RestoreBackup(path, config.DB.Path)
+	if err != nil {
+		logrus.Fatalf("Error restoring: %+v", err)
+	}
+	fmt.Printf("Restored %d instances at schema version %d\n", info.Instances, info.SchemaVersion)
+	if info.SchemaVersion < model.SchemaVersion() {
+		fmt.Println("The schema is migrated when the server starts")
+	}
+}
+
+func check(config *conf.Config, repair bool) {
+	if config.GitOps.Dir == "" && config.DB.Driver == "memory" {
+		logrus.Fatal("The memory driver keeps no instances to check the database against")
+	}
+	db, err := conf.BoltConnect(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	version, err := model.ReadSchemaVersion(db)
+	if err != nil {
+		logrus.Fatalf("Error reading schema version: %+v", err)
+	}
+	if version > model.SchemaVersion() {
+		logrus.Fatalf("%s: database at version %d, supported up to %d", model.ErrSchemaTooNew, version, model.SchemaVersion())
+	}
+	// the events and fetches belong to the instances served, wherever
+	// they're kept
+	var instances model.InstanceRepository
+	if config.GitOps.Dir != "" {
+		source, err := model.NewDirectorySource(config.GitOps.Dir)
+		if err != nil {
+			logrus.Fatalf("Error loading %s: %+v", config.GitOps.Dir, err)
+		}
+		instances = model.NewDirInstanceRepository(source)
+	} else if config.DB.Driver != "" && config.DB.Driver != model.DefaultStorageDriver {
+		storage, err := model.OpenStorage(config.DB.Driver, db, config.DB.DSN)
+		if err != nil {
+			logrus.Fatalf("Error opening storage: %+v", err)
+		}
+		defer storage.Close()
+		instances = storage.Instances
+	}
+	report, err := model.CheckDB(db, instances, repair)
+	if err != nil {
+		logrus.Fatalf("Error checking database: %+v", err)
+	}
+
+	for _, p := range report.Problems {
+		state := ""
+		if p.Repaired {
+			state = " (repaired)"
+		}
+		fmt.Printf("%s %s %s: %s%s\n", p.Kind, p.Bucket, p.Key, p.Message, state)
+	}
+	unrepaired := len(report.Unrepaired())
+	fmt.Printf("%d records checked, %d problems found", report.Records, len(report.Problems))
+	if repair {
+		fmt.Printf(", %d repaired", len(report.Problems)-unrepaired)
+	}
+	fmt.Println()
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
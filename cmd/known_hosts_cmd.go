@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/spf13/cobra"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+var knownHostsCmd = cobra.Command{
+	Use:   "known-hosts",
+	Short: "Write a known_hosts file",
+	Long: "Write an OpenSSH known_hosts file with the host keys reported by the instances. " +
+		"Reads the database unless --server is given to fetch it from a running server",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		hashed, _ := cmd.Flags().GetBool("hashed")
+		server, _ := cmd.Flags().GetString("server")
+
+		var content []byte
+		var err error
+		if server != "" {
+			token, _ := cmd.Flags().GetString("token")
+			content, err = fetchKnownHosts(server, token, hashed)
+		} else {
+			execWithConfig(cmd, func(config *conf.Config) {
+				content, err = readKnownHosts(config, hashed)
+			})
+		}
+		if err != nil {
+			logrus.Fatalf("Error creating known_hosts: %+v", err)
+		}
+
+		if output == "" || output == "-" {
+			os.Stdout.Write(content)
+			return
+		}
+		if err := ioutil.WriteFile(output, content, 0644); err != nil {
+			logrus.Fatalf("Error writing %s: %+v", output, err)
+		}
+	},
+}
+
+func init() {
+	knownHostsCmd.Flags().StringP("output", "o", "", "File to write, stdout by default")
+	knownHostsCmd.Flags().Bool("hashed", false, "Hash host names like ssh-keygen -H")
+	knownHostsCmd.Flags().String("server", "", "URL of a running server, e.g. https://cloud-initer:8000")
+	knownHostsCmd.Flags().String("token", os.Getenv("CLOUD_INITER_TOKEN"), "API token for --server")
+}
+
+func readKnownHosts(config *conf.Config, hashed bool) ([]byte, error) {
+	_, storage, err := openStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	service := model.NewInstanceService(storage.Instances, nil, validator.New())
+	items, err := service.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	return model.KnownHosts(items, hashed)
+}
+
+func fetchKnownHosts(server, token string, hashed bool) ([]byte, error) {
+	status, body, err := apiRequest(http.MethodGet, server, token, fmt.Sprintf("/api/v1/known_hosts?hashed=%t", hashed), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, apiError(status, body)
+	}
+	return body, nil
+}
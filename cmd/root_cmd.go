@@ -17,7 +17,7 @@ var rootCmd = cobra.Command{
 // NewRoot will add flags and subcommands to the different commands
 func RootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringP("config", "c", "", "The configuration file")
-	rootCmd.AddCommand(&serveCmd, &versionCmd)
+	rootCmd.AddCommand(&serveCmd, &versionCmd, &tokenCmd, &knownHostsCmd, &exportCmd, &importCmd, &dbCmd)
 	return &rootCmd
 }
 
@@ -20,15 +20,22 @@ var serveCmd = cobra.Command{
 }
 
 func serve(config *conf.Config) {
-	db, err := conf.BoltConnect(config)
+	db, storage, err := openStorage(config)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
 
-	apiServer := api.NewAPI(config, db)
+	apiServer, err := api.NewAPI(config, db, storage)
+	if err != nil {
+		logrus.Fatalf("Error creating API server: %+v", err)
+	}
 
 	l := fmt.Sprintf("%v:%v", config.API.Host, config.API.Port)
 	logrus.Infof("API started on: %s", l)
+	if config.Metadata.Enabled() {
+		l := fmt.Sprintf("%v:%v", config.Metadata.Host, config.Metadata.Port)
+		logrus.Infof("Metadata datasource started on: %s", l)
+	}
 
 	closer.Bind(func() {
 		err := apiServer.Stop()
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/boltdb/bolt"
+	"github.com/xlab/closer"
+)
+
+// openDB opens the Bolt database and migrates it to the current schema,
+// refusing databases of a newer one
+func openDB(config *conf.Config) (*bolt.DB, error) {
+	db, err := conf.BoltConnect(config)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := model.Migrate(db, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		logrus.Infof("Migrated the database to version %d: %s", step.Version, step.Description)
+	}
+	return db, nil
+}
+
+// openStorage opens the Bolt database and the storage of the configured
+// driver
+func openStorage(config *conf.Config) (*bolt.DB, *model.Storage, error) {
+	db, err := openDB(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	storage, err := model.OpenStorage(config.DB.Driver, db, config.DB.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	closer.Bind(func() {
+		if err := storage.Close(); err != nil {
+			logrus.Errorf("Error closing storage: %s", err.Error())
+		}
+	})
+	return db, storage, nil
+}
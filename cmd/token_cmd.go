@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/andrexus/cloud-initer/conf"
+	"github.com/andrexus/cloud-initer/model"
+	"github.com/spf13/cobra"
+)
+
+var tokenCmd = cobra.Command{
+	Use:   "token",
+	Short: "Manage API tokens",
+	Long:  "Create, list and revoke tokens used to access the management API",
+}
+
+var tokenCreateCmd = cobra.Command{
+	Use:   "create",
+	Short: "Create API token",
+	Long:  "Create a new API token. The token is printed once and can't be shown again",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.Config) {
+			name, _ := cmd.Flags().GetString("name")
+			role, _ := cmd.Flags().GetString("role")
+			scope, _ := cmd.Flags().GetStringSlice("scope")
+			ttl, _ := cmd.Flags().GetDuration("ttl")
+			labels, err := model.ParseLabels(scope)
+			if err != nil {
+				logrus.Fatalf("%+v", err)
+			}
+			item := &model.Token{Name: name, Role: model.Role(role), Scope: labels}
+			createToken(config, item, ttl)
+		})
+	},
+}
+
+var tokenListCmd = cobra.Command{
+	Use:   "list",
+	Short: "List API tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, listTokens)
+	},
+}
+
+var tokenRevokeCmd = cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke API token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.Config) {
+			revokeToken(config, args[0])
+		})
+	},
+}
+
+func init() {
+	tokenCreateCmd.Flags().StringP("name", "n", "", "Token name, e.g. the user or system using it")
+	tokenCreateCmd.Flags().StringP("role", "r", string(model.RoleViewer), "Token role: viewer, operator or admin")
+	tokenCreateCmd.Flags().StringSlice("scope", nil, "Only allow access to instances with this label (key=value), can be repeated")
+	tokenCreateCmd.Flags().Duration("ttl", 0, "Token lifetime, e.g. 720h. Tokens don't expire by default")
+	tokenCmd.AddCommand(&tokenCreateCmd, &tokenListCmd, &tokenRevokeCmd)
+}
+
+func tokenService(config *conf.Config) model.TokenService {
+	db, err := openDB(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	return model.NewTokenService(model.NewTokenRepository(db))
+}
+
+func createToken(config *conf.Config, item *model.Token, ttl time.Duration) {
+	item, secret, err := tokenService(config).Create(item, ttl)
+	if err != nil {
+		logrus.Fatalf("Error creating token: %+v", err)
+	}
+	fmt.Printf("Created %s token %s (%s)\n", item.Role, item.ID.Hex(), item.Name)
+	fmt.Println(secret)
+}
+
+func listTokens(config *conf.Config) {
+	items, err := tokenService(config).FindAll()
+	if err != nil {
+		logrus.Fatalf("Error listing tokens: %+v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tROLE\tSCOPE\tCREATED\tEXPIRES")
+	for _, item := range items {
+		expires := "never"
+		if !item.ExpiresAt.IsZero() {
+			expires = item.ExpiresAt.Format(time.RFC3339)
+			if item.Expired() {
+				expires += " (expired)"
+			}
+		}
+		scope := []string{}
+		for k, v := range item.Scope {
+			scope = append(scope, k+"="+v)
+		}
+		sort.Strings(scope)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", item.ID.Hex(), item.Name, item.Principal().Role,
+			strings.Join(scope, ","), item.CreatedAt.Format(time.RFC3339), expires)
+	}
+	w.Flush()
+}
+
+func revokeToken(config *conf.Config, id string) {
+	if err := tokenService(config).Revoke(id); err != nil {
+		logrus.Fatalf("Error revoking token: %+v", err)
+	}
+	fmt.Printf("Revoked token %s\n", id)
+}
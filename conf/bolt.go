@@ -1,19 +1,22 @@
 package conf
 
 import (
-	"log"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
 	"github.com/xlab/closer"
 )
 
 // BoltConnect opens bolt database
 func BoltConnect(config *Config) (*bolt.DB, error) {
 
-	db, err := bolt.Open(config.DB.Path, 0600, nil)
+	// don't block forever when another process (e.g. a running server)
+	// holds the file lock
+	db, err := bolt.Open(config.DB.Path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.Wrapf(err, "opening %s", config.DB.Path)
 	}
 
 	closer.Bind(func() {
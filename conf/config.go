@@ -16,20 +16,133 @@ import (
 // Config the application's configuration
 type Config struct {
 	API struct {
-		Host string `mapstructure:"host" json:"host"`
-		Port int    `mapstructure:"port" json:"port"`
+		Host string    `mapstructure:"host" json:"host"`
+		Port int       `mapstructure:"port" json:"port"`
+		JWT  JWTConfig `mapstructure:"jwt" json:"jwt"`
+		TLS  TLSConfig `mapstructure:"tls" json:"tls"`
 	} `mapstructure:"api" json:"api"`
 
+	Metadata MetadataConfig `mapstructure:"metadata" json:"metadata"`
+
 	DB struct {
 		Path string `mapstructure:"path" json:"path"`
+		// Driver stores the instances and the environment in "bolt", the
+		// database at Path, "memory" or "sqlite" (needs the sqlite build
+		// tag). Everything else stays in the Bolt database.
+		Driver string `mapstructure:"driver" json:"driver"`
+		// DSN is the database of the driver, the file for sqlite
+		DSN string `mapstructure:"dsn" json:"dsn"`
 	} `mapstructure:"db" json:"db"`
 
+	GitOps struct {
+		// Dir serves the environment and the instances from a directory
+		// of YAML files instead of the database, reloaded when it
+		// changes. The management API can't change them then.
+		Dir string `mapstructure:"dir" json:"dir"`
+	} `mapstructure:"gitops" json:"gitops"`
+
+	Events struct {
+		// MaxPerInstance caps the cloud-init reporting events kept for
+		// each instance, the oldest are dropped first
+		MaxPerInstance int `mapstructure:"max_per_instance" json:"max_per_instance"`
+	} `mapstructure:"events" json:"events"`
+
+	Fetches struct {
+		// RetentionDays is how long the log of document fetches is kept
+		RetentionDays int `mapstructure:"retention_days" json:"retention_days"`
+	} `mapstructure:"fetches" json:"fetches"`
+
+	Trash struct {
+		// RetentionDays is how long deleted instances can be restored
+		// before they're purged
+		RetentionDays int `mapstructure:"retention_days" json:"retention_days"`
+	} `mapstructure:"trash" json:"trash"`
+
+	Backup struct {
+		// Dir receives a copy of the database every IntervalHours, the
+		// newest Keep copies are kept. No copies are made without it.
+		Dir           string `mapstructure:"dir" json:"dir"`
+		IntervalHours int    `mapstructure:"interval_hours" json:"interval_hours"`
+		Keep          int    `mapstructure:"keep" json:"keep"`
+	} `mapstructure:"backup" json:"backup"`
+
+	Audit struct {
+		// File receives every audit entry as a line of JSON, e.g. for
+		// shipping them to a log collector
+		File string `mapstructure:"file" json:"file"`
+	} `mapstructure:"audit" json:"audit"`
+
 	LogConf struct {
 		Level string `mapstructure:"level"`
 		File  string `mapstructure:"file"`
 	} `mapstructure:"log_conf"`
 }
 
+// MetadataConfig moves the cloud-init datasource to its own listener,
+// e.g. 169.254.169.254:80. It's served on the API listener unless a
+// port is set.
+type MetadataConfig struct {
+	Host string    `mapstructure:"host" json:"host"`
+	Port int       `mapstructure:"port" json:"port"`
+	TLS  TLSConfig `mapstructure:"tls" json:"tls"`
+	// ResolveBy lists how guests may be matched to instances: by "ip",
+	// or by "mac" or "path" (ID or name) from /nocloud/<key>/user-data.
+	// Only "ip" is allowed by default, as any guest can put any key in
+	// the path.
+	ResolveBy []string `mapstructure:"resolve_by" json:"resolve_by"`
+}
+
+// Enabled reports whether the metadata datasource has its own listener
+func (c *MetadataConfig) Enabled() bool {
+	return c.Port != 0
+}
+
+// JWTConfig enables bearer JWTs issued by an OIDC provider next to API tokens.
+// Signing keys come from exactly one of JWKSURL, JWKSFile or KeyFile.
+type JWTConfig struct {
+	JWKSURL  string `mapstructure:"jwks_url" json:"jwks_url"`
+	JWKSFile string `mapstructure:"jwks_file" json:"jwks_file"`
+	// KeyFile is a PEM encoded RSA or ECDSA public key
+	KeyFile  string `mapstructure:"key_file" json:"key_file"`
+	Issuer   string `mapstructure:"issuer" json:"issuer"`
+	Audience string `mapstructure:"audience" json:"audience"`
+	// NameClaim identifies the principal, "sub" by default
+	NameClaim string `mapstructure:"name_claim" json:"name_claim"`
+	// RolesClaim holds a string or list of strings, "roles" by default
+	RolesClaim string `mapstructure:"roles_claim" json:"roles_claim"`
+	// Roles maps claim values to roles. Without it claim values are used
+	// as role names.
+	Roles map[string]string `mapstructure:"roles" json:"roles"`
+}
+
+// Enabled reports whether any signing key source is configured
+func (c *JWTConfig) Enabled() bool {
+	return c.JWKSURL != "" || c.JWKSFile != "" || c.KeyFile != ""
+}
+
+// TLSConfig enables HTTPS. The files are reloaded when they change.
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file" json:"cert_file"`
+	KeyFile  string `mapstructure:"key_file" json:"key_file"`
+	// ClientCAFile enables mutual TLS for the management API
+	ClientCAFile string `mapstructure:"client_ca_file" json:"client_ca_file"`
+}
+
+// Enabled reports whether a certificate is configured
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c *TLSConfig) validate(prefix string) error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.Errorf("%s.cert_file and %s.key_file must be set together", prefix, prefix)
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		return errors.Errorf("%s.client_ca_file requires %s.cert_file", prefix, prefix)
+	}
+	return nil
+}
+
 // Load will construct the config from the file
 func Load(configFile string) (*Config, error) {
 	viper.SetConfigType("json")
@@ -104,5 +217,87 @@ func validateConfig(config *Config) (*Config, error) {
 		config.API.Port = 8080
 	}
 
+	if config.Events.MaxPerInstance == 0 {
+		config.Events.MaxPerInstance = 500
+	}
+
+	if config.Fetches.RetentionDays == 0 {
+		config.Fetches.RetentionDays = 30
+	}
+	if config.Fetches.RetentionDays < 1 {
+		return nil, errors.New("fetches.retention_days must be at least 1")
+	}
+
+	if config.Trash.RetentionDays == 0 {
+		config.Trash.RetentionDays = 30
+	}
+	if config.Trash.RetentionDays < 1 {
+		return nil, errors.New("trash.retention_days must be at least 1")
+	}
+
+	if config.Backup.IntervalHours == 0 {
+		config.Backup.IntervalHours = 24
+	}
+
+	if config.Backup.Keep == 0 {
+		config.Backup.Keep = 7
+	}
+	if config.Backup.IntervalHours < 1 {
+		return nil, errors.New("backup.interval_hours must be at least 1")
+	}
+	if config.Backup.Keep < 1 {
+		return nil, errors.New("backup.keep must be at least 1")
+	}
+	if config.Backup.Dir != "" && config.DB.Driver != "" && config.DB.Driver != "bolt" {
+		return nil, errors.Errorf("backup.dir only works with the bolt db.driver, not %s", config.DB.Driver)
+	}
+
+	if len(config.Metadata.ResolveBy) == 0 {
+		config.Metadata.ResolveBy = []string{"ip"}
+	}
+	for _, method := range config.Metadata.ResolveBy {
+		switch method {
+		case "ip", "mac", "path":
+		default:
+			return nil, errors.Errorf("unknown metadata.resolve_by method '%s'", method)
+		}
+	}
+
+	if err := config.API.TLS.validate("api.tls"); err != nil {
+		return nil, err
+	}
+
+	if err := config.Metadata.TLS.validate("metadata.tls"); err != nil {
+		return nil, err
+	}
+	if config.Metadata.TLS.ClientCAFile != "" {
+		return nil, errors.New("metadata.tls.client_ca_file is not supported, guests have no client certificates")
+	}
+	if config.Metadata.Enabled() && config.Metadata.Host == config.API.Host && config.Metadata.Port == config.API.Port {
+		return nil, errors.New("metadata and api must listen on different addresses")
+	}
+
+	jwt := &config.API.JWT
+	if jwt.Enabled() {
+		sources := 0
+		for _, s := range []string{jwt.JWKSURL, jwt.JWKSFile, jwt.KeyFile} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return nil, errors.New("only one of api.jwt.jwks_url, jwks_file and key_file can be set")
+		}
+		if jwt.Issuer == "" || jwt.Audience == "" {
+			return nil, errors.New("api.jwt.issuer and api.jwt.audience are required")
+		}
+		if jwt.NameClaim == "" {
+			jwt.NameClaim = "sub"
+		}
+		if jwt.RolesClaim == "" {
+			jwt.RolesClaim = "roles"
+		}
+	}
+
 	return config, nil
 }
@@ -47,3 +47,30 @@ func TestConfigWithOverrides(t *testing.T) {
 	assert.EqualValues(t, "api-host", config.API.Host)
 	assert.EqualValues(t, 8000, config.API.Port)
 }
+
+func TestConfigRejectsNegativeSettings(t *testing.T) {
+	for name, set := range map[string]func(c *Config){
+		"backup.interval_hours":  func(c *Config) { c.Backup.IntervalHours = -1 },
+		"backup.keep":            func(c *Config) { c.Backup.Keep = -1 },
+		"fetches.retention_days": func(c *Config) { c.Fetches.RetentionDays = -1 },
+		"trash.retention_days":   func(c *Config) { c.Trash.RetentionDays = -1 },
+	} {
+		config := new(Config)
+		set(config)
+		_, err := validateConfig(config)
+		if assert.NotNil(t, err, name) {
+			assert.Contains(t, err.Error(), name)
+		}
+	}
+
+	config := new(Config)
+	config.Backup.Dir = "backups"
+	config.DB.Driver = "sqlite"
+	_, err := validateConfig(config)
+	assert.NotNil(t, err)
+
+	config, err = validateConfig(new(Config))
+	assert.Nil(t, err)
+	assert.Equal(t, 24, config.Backup.IntervalHours)
+	assert.Equal(t, 7, config.Backup.Keep)
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v2"
+)
+
+// Actor is who made a change through the management API
+type Actor struct {
+	Name     string `json:"name"`
+	SourceIP string `json:"sourceIp"`
+}
+
+// AuditAction is the kind of change an audit entry records
+type AuditAction string
+
+const (
+	AuditCreate     AuditAction = "create"
+	AuditUpdate     AuditAction = "update"
+	AuditDelete     AuditAction = "delete"
+	AuditArm        AuditAction = "arm"
+	AuditTransition AuditAction = "status"
+	AuditRestore    AuditAction = "restore"
+	AuditUndelete   AuditAction = "undelete"
+	AuditPurge      AuditAction = "purge"
+)
+
+// resources changes are audited for
+const (
+	ResourceInstance    = "instance"
+	ResourceEnvironment = "environment"
+)
+
+// AuditEntry records a single change
+type AuditEntry struct {
+	Timestamp  time.Time   `json:"timestamp"`
+	Actor      Actor       `json:"actor"`
+	Action     AuditAction `json:"action"`
+	Resource   string      `json:"resource"`
+	ResourceID string      `json:"resourceId,omitempty"`
+	// Diff is a unified diff between the YAML renderings of the
+	// resource before and after the change
+	Diff string `json:"diff"`
+}
+
+// AuditFilter selects audit entries, empty fields match everything
+type AuditFilter struct {
+	Actor      string
+	Action     AuditAction
+	Resource   string
+	ResourceID string
+	Since      time.Time
+	Until      time.Time
+	// Limit caps the number of entries returned, newest first
+	Limit int
+}
+
+// Matches reports whether the entry is selected by the filter
+func (f *AuditFilter) Matches(entry *AuditEntry) bool {
+	switch {
+	case f.Actor != "" && entry.Actor.Name != f.Actor:
+		return false
+	case f.Action != "" && entry.Action != f.Action:
+		return false
+	case f.Resource != "" && entry.Resource != f.Resource:
+		return false
+	case f.ResourceID != "" && entry.ResourceID != f.ResourceID:
+		return false
+	case !f.Since.IsZero() && entry.Timestamp.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.Timestamp.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+type AuditService interface {
+	Find(filter *AuditFilter) ([]AuditEntry, error)
+	// Record stores a change of a resource from before to after, either
+	// of which is nil when the resource is created or deleted
+	Record(actor *Actor, action AuditAction, resource, id string, before, after interface{}) error
+}
+
+type AuditServiceImpl struct {
+	Repository AuditRepository
+	// File receives every entry as a line of JSON when set
+	File string
+
+	mu sync.Mutex
+}
+
+func NewAuditService(repository AuditRepository, file string) *AuditServiceImpl {
+	service := &AuditServiceImpl{
+		Repository: repository,
+		File:       file,
+	}
+	return service
+}
+
+func (c *AuditServiceImpl) Find(filter *AuditFilter) ([]AuditEntry, error) {
+	return c.Repository.Find(filter)
+}
+
+func (c *AuditServiceImpl) Record(actor *Actor, action AuditAction, resource, id string, before, after interface{}) error {
+	diff, err := Diff(before, after)
+	if err != nil {
+		return errors.Wrap(err, "creating audit diff")
+	}
+	entry := &AuditEntry{
+		Timestamp:  time.Now(),
+		Actor:      *actor,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: id,
+		Diff:       diff,
+	}
+	if err := c.Repository.Append(entry); err != nil {
+		return errors.Wrap(err, "storing audit entry")
+	}
+	if c.File != "" {
+		if err := c.appendToFile(entry); err != nil {
+			return errors.Wrapf(err, "writing audit entry to %s", c.File)
+		}
+	}
+	return nil
+}
+
+// auditChange records a change that is already stored, unless it was
+// made without an actor. A failure is logged instead of returned, the
+// client would retry a change that went through otherwise.
+func auditChange(audit AuditService, actor *Actor, action AuditAction, resource, id string, before, after interface{}) {
+	if actor == nil || audit == nil {
+		return
+	}
+	if err := audit.Record(actor, action, resource, id, before, after); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"component": "audit",
+			"action":    action,
+			"resource":  resource,
+			"id":        id,
+		}).Error("Failed to record the change")
+	}
+}
+
+func (c *AuditServiceImpl) appendToFile(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Diff renders both versions as YAML, where multi-line user-data and
+// configs stay readable, and returns a unified diff. Either may be nil.
+func Diff(before, after interface{}) (string, error) {
+	a, err := auditText(before)
+	if err != nil {
+		return "", err
+	}
+	b, err := auditText(after)
+	if err != nil {
+		return "", err
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(a),
+		B:        splitLines(b),
+		FromFile: "before",
+		ToFile:   "after",
+		Context:  3,
+	})
+}
+
+// splitLines keeps a missing version from showing up as an empty line
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return difflib.SplitLines(strings.TrimSuffix(s, "\n"))
+}
+
+func auditText(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	// JSON is YAML, decoding it into a MapSlice keeps the field order
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(enc, &doc); err != nil {
+		return "", err
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// audit entries are keyed by sequence, so they are stored in order
+var auditBucket = []byte("audit")
+
+type AuditRepository interface {
+	// Find returns the entries matching the filter, newest first
+	Find(filter *AuditFilter) ([]AuditEntry, error)
+	Append(entry *AuditEntry) error
+}
+
+type BoltAuditRepository struct {
+	db *bolt.DB
+}
+
+func NewAuditRepository(db *bolt.DB) *BoltAuditRepository {
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(auditBucket)
+		return err
+	})
+	return &BoltAuditRepository{db}
+}
+
+func (r *BoltAuditRepository) Find(filter *AuditFilter) ([]AuditEntry, error) {
+	items := []AuditEntry{}
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var item AuditEntry
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if !filter.Since.IsZero() && item.Timestamp.Before(filter.Since) {
+				// everything before is older still
+				break
+			}
+			if !filter.Matches(&item) {
+				continue
+			}
+			items = append(items, item)
+			if filter.Limit > 0 && len(items) == filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *BoltAuditRepository) Append(entry *AuditEntry) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		enc, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(sequenceKey(seq), enc)
+	})
+}
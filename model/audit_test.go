@@ -0,0 +1,59 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// a change that is stored stays successful when it can't be audited
+func TestAuditFailureKeepsChange(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "cloud-initer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// a directory can't be appended to
+	audit := NewAuditService(NewAuditRepository(db), dir)
+	service := NewInstanceService(NewInstanceRepository(db), audit, validator.New())
+	actor := &Actor{Name: "admin"}
+
+	item, err := service.Create(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"}, actor)
+	assert.Nil(t, err)
+	assert.Nil(t, service.Delete(item.ID.Hex(), 0, actor))
+
+	entries, err := audit.Find(&AuditFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+// the environment holds secrets, its audit entries only tell which
+// values changed
+func TestAuditRedactsEnvironment(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	audit := NewAuditService(NewAuditRepository(db), "")
+	service := NewEnvironmentService(NewEnvironmentRepository(db), audit, validator.New())
+	actor := &Actor{Name: "admin"}
+
+	_, err := service.Update(&Environment{Config: "user: admin\npassword: s3cret\n"}, actor)
+	assert.Nil(t, err)
+	_, err = service.Update(&Environment{Config: "user: admin\npassword: t0psecret\n"}, actor)
+	assert.Nil(t, err)
+
+	entries, err := audit.Find(&AuditFilter{})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Diff, "s3cret")
+		assert.NotContains(t, entry.Diff, "t0psecret")
+		assert.NotContains(t, entry.Diff, ": admin")
+	}
+	// the changed value shows up, the unchanged one doesn't
+	assert.Contains(t, entries[0].Diff, "-  password: '"+redactedValue)
+	assert.Contains(t, entries[0].Diff, "+  password: '"+redactedValue)
+	assert.NotContains(t, entries[0].Diff, "-  user:")
+}
@@ -0,0 +1,200 @@
+package model
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// backup files written on a schedule are named by the time they were
+// taken, so they sort by age
+const (
+	backupPrefix     = "cloud-initer-"
+	backupSuffix     = ".bolt"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// ErrBackupUnsupported is returned for storage drivers keeping the
+// instances and the environment outside the Bolt database, a copy of it
+// would leave them out
+var ErrBackupUnsupported = errors.New("backups only cover the bolt storage driver")
+
+// CheckBackupDriver fails with ErrBackupUnsupported unless the storage
+// driver keeps everything in the Bolt database
+func CheckBackupDriver(driver string) error {
+	if driver == "" || driver == DefaultStorageDriver {
+		return nil
+	}
+	return errors.Wrapf(ErrBackupUnsupported, "db.driver is %s", driver)
+}
+
+// WriteBackup writes a consistent copy of the database, the server can
+// keep running meanwhile. size is called with the size of the copy
+// before it's written.
+func WriteBackup(db *bolt.DB, w io.Writer, size func(int64)) error {
+	return db.View(func(tx *bolt.Tx) error {
+		if size != nil {
+			size(tx.Size())
+		}
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// BackupToFile writes a copy of the database to path. The file only
+// appears once it's complete.
+func BackupToFile(db *bolt.DB, path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := WriteBackup(db, f, nil); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// BackupName is the file name of a scheduled backup taken at t
+func BackupName(t time.Time) string {
+	return backupPrefix + t.UTC().Format(backupTimeFormat) + backupSuffix
+}
+
+// RotateBackups removes the scheduled backups in dir beyond the newest
+// keep ones and returns the files removed
+func RotateBackups(dir string, keep int) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, f := range files {
+		name := f.Name()
+		if f.Mode().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	var removed []string
+	for i := keep; i < len(backups); i++ {
+		path := filepath.Join(dir, backups[i])
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// BackupInfo describes a backup file that passed validation
+type BackupInfo struct {
+	SchemaVersion int
+	Instances     int
+}
+
+// ValidateBackup checks that path is a Bolt database this version can
+// read: its schema is not newer and its instances and environment
+// decode
+func ValidateBackup(path string) (*BackupInfo, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	defer db.Close()
+
+	info := new(BackupInfo)
+	err = db.View(func(tx *bolt.Tx) error {
+		info.SchemaVersion = schemaVersion(tx)
+		if info.SchemaVersion > SchemaVersion() {
+			return errors.Wrapf(ErrSchemaTooNew, "backup at version %d, supported up to %d", info.SchemaVersion, SchemaVersion())
+		}
+		if b := tx.Bucket(instanceBucket); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				if _, err := decode(v); err != nil {
+					return errors.Wrapf(err, "instance %s", k)
+				}
+				info.Instances++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket(environmentBucket); b != nil {
+			if v := b.Get(environmentKey); len(v) > 0 {
+				if _, err := decodeEnvironment(v); err != nil {
+					return errors.Wrap(err, "environment")
+				}
+			}
+		}
+		// the page structure, the first problem is reported
+		var corrupt error
+		for err := range tx.Check() {
+			if corrupt == nil {
+				corrupt = err
+			}
+		}
+		return corrupt
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// RestoreBackup replaces the database at dbPath with the backup after
+// validating it. The database must not be open. The replaced file is
+// kept next to it with the suffix .pre-restore.
+func RestoreBackup(backupPath, dbPath string) (*BackupInfo, error) {
+	info, err := ValidateBackup(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(dbPath), filepath.Base(dbPath)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dst.Name())
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		if err := os.Rename(dbPath, dbPath+".pre-restore"); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Rename(dst.Name(), dbPath); err != nil {
+		return nil, errors.Wrapf(err, "restoring %s, the previous database is at %s.pre-restore", dbPath, dbPath)
+	}
+	return info, nil
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupRestore(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	_, err := Migrate(db, false)
+	assert.Nil(t, err)
+	_, err = NewInstanceRepository(db).Save(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"})
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "cloud-initer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, BackupToFile(db, filepath.Join(dir, BackupName(start.Add(time.Duration(i)*time.Hour)))))
+	}
+	removed, err := RotateBackups(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, BackupName(start))}, removed)
+
+	backup := filepath.Join(dir, BackupName(start.Add(2*time.Hour)))
+	info, err := ValidateBackup(backup)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, info.Instances)
+	assert.Equal(t, SchemaVersion(), info.SchemaVersion)
+
+	target := filepath.Join(dir, "restored.bolt")
+	assert.Nil(t, ioutil.WriteFile(target, []byte("previous"), 0600))
+	_, err = RestoreBackup(backup, target)
+	assert.Nil(t, err)
+	previous, err := ioutil.ReadFile(target + ".pre-restore")
+	assert.Nil(t, err)
+	assert.Equal(t, "previous", string(previous))
+	restored, err := bolt.Open(target, 0600, nil)
+	assert.Nil(t, err)
+	item, err := NewInstanceRepository(restored).FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "web1", item.Name)
+	restored.Close()
+
+	// the database is kept when the backup is unusable
+	_, err = RestoreBackup(target+".pre-restore", target)
+	assert.NotNil(t, err)
+	_, err = os.Stat(target)
+	assert.Nil(t, err)
+}
+
+func TestCheckBackupDriver(t *testing.T) {
+	assert.Nil(t, CheckBackupDriver(""))
+	assert.Nil(t, CheckBackupDriver("bolt"))
+	for _, driver := range []string{"memory", "sqlite"} {
+		assert.Equal(t, ErrBackupUnsupported, errors.Cause(CheckBackupDriver(driver)))
+	}
+}
@@ -0,0 +1,266 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BatchOp is the kind of change a batch operation makes
+type BatchOp string
+
+const (
+	BatchCreate BatchOp = "create"
+	BatchUpdate BatchOp = "update"
+	BatchDelete BatchOp = "delete"
+)
+
+// MaxBatchOperations caps the operations of a single batch sent to the
+// API
+const MaxBatchOperations = 1000
+
+var (
+	ErrOutOfScope = errors.New("instance is outside of your scope")
+	// ErrBatchRolledBack is the result of the operations of an atomic
+	// batch that succeeded but were rolled back along with the failed ones
+	ErrBatchRolledBack = errors.New("rolled back, another operation failed")
+	// errDryRun rolls back the transaction of a dry run
+	errDryRun = errors.New("dry run")
+)
+
+// BatchOptions control how a batch is applied
+type BatchOptions struct {
+	// Atomic rolls the batch back as a whole when any operation fails,
+	// otherwise only the failed operations are skipped
+	Atomic bool
+	// DryRun validates and applies the operations, then rolls them back
+	DryRun bool
+}
+
+// BatchOperation is a single change of a batch. Creates and updates
+// carry the Instance, updates and deletes the ID of the stored instance.
+// Creates take the ID for the new instance when given. A Revision other
+// than 0 has to match the stored instance; for updates it defaults to
+// the revision of the Instance.
+type BatchOperation struct {
+	Op       BatchOp   `json:"op"`
+	ID       string    `json:"id"`
+	Revision uint64    `json:"revision"`
+	Instance *Instance `json:"instance"`
+}
+
+// BatchResult is the outcome of the operation at Index. Err is either a
+// validator.ValidationErrors or one of the errors of this package.
+type BatchResult struct {
+	Index    int
+	Op       BatchOp
+	ID       string
+	Instance *Instance
+	Err      error
+}
+
+// InstanceBatch reads and writes instances within the transaction of a
+// batch, so every operation sees the changes of the ones before
+type InstanceBatch interface {
+	instanceLookup
+	FindOne(id string) (*Instance, error)
+	// InTrash reports whether the ID is taken by a trashed instance
+	InTrash(id string) (bool, error)
+	FindTrashed(id string) (*TrashedInstance, error)
+	Save(item *Instance) (*Instance, error)
+	Delete(id string, revision uint64, deletedBy string) error
+	Undelete(id string) (*Instance, error)
+}
+
+// batchChange is an applied operation to audit once the batch is stored
+type batchChange struct {
+	action        AuditAction
+	before, after *Instance
+}
+
+func (c *InstanceServiceImpl) Batch(ops []BatchOperation, options BatchOptions, principal *Principal, actor *Actor) ([]BatchResult, error) {
+	deletedBy := ""
+	if actor != nil {
+		deletedBy = actor.Name
+	}
+	var results []BatchResult
+	var changes []batchChange
+	err := c.Repository.Batch(func(batch InstanceBatch) error {
+		results = make([]BatchResult, len(ops))
+		changes = nil
+		failed := false
+		for i := range ops {
+			result, change, err := c.apply(batch, &ops[i], principal, deletedBy)
+			if err != nil {
+				return err
+			}
+			result.Index = i
+			results[i] = *result
+			if result.Err != nil {
+				failed = true
+			} else {
+				changes = append(changes, *change)
+			}
+		}
+		if options.Atomic && failed {
+			return ErrBatchRolledBack
+		}
+		if options.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return results, nil
+	}
+	if err == ErrBatchRolledBack {
+		for i := range results {
+			if results[i].Err == nil {
+				if results[i].Op == BatchCreate {
+					results[i].ID = ""
+				}
+				results[i].Instance = nil
+				results[i].Err = ErrBatchRolledBack
+			}
+		}
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		c.audit(actor, change.action, change.before, change.after)
+	}
+	return results, nil
+}
+
+// apply carries out a single operation of a batch. Operations that
+// fail are reported in the result, the error is reserved for failures
+// of the batch itself.
+func (c *InstanceServiceImpl) apply(batch InstanceBatch, op *BatchOperation, principal *Principal, deletedBy string) (*BatchResult, *batchChange, error) {
+	result := &BatchResult{Op: op.Op, ID: op.ID}
+	fail := func(err error) (*BatchResult, *batchChange, error) {
+		result.Err = err
+		return result, nil, nil
+	}
+
+	if op.Op == BatchCreate {
+		if op.Instance == nil {
+			return fail(errors.New("instance is required"))
+		}
+		item := *op.Instance
+		item.reset()
+		if !principal.CanAccess(&item) {
+			return fail(ErrOutOfScope)
+		}
+		if op.ID != "" {
+			if err := checkNewID(batch, op.ID); err != nil {
+				if _, ok := err.(idTakenError); ok {
+					return fail(err)
+				}
+				return nil, nil, err
+			}
+			now := time.Now()
+			item.ID = bson.ObjectIdHex(op.ID)
+			item.CreatedAt, item.UpdatedAt = now, now
+		}
+		if err := c.validateInBatch(batch, &item); err != nil {
+			return fail(err)
+		}
+		saved, err := batch.Save(&item)
+		if err != nil {
+			return nil, nil, err
+		}
+		result.ID, result.Instance = saved.ID.Hex(), saved
+		return result, &batchChange{action: AuditCreate, after: saved}, nil
+	}
+
+	if op.Op != BatchUpdate && op.Op != BatchDelete {
+		return fail(errors.Errorf("unknown operation '%s'", op.Op))
+	}
+	item, err := batch.FindOne(op.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if item == nil {
+		return fail(ErrInstanceNotFound)
+	}
+	if !principal.CanAccess(item) {
+		return fail(ErrOutOfScope)
+	}
+	revision := op.Revision
+	if revision == 0 && op.Op == BatchUpdate && op.Instance != nil {
+		revision = op.Instance.Revision
+	}
+	if revision != 0 && revision != item.Revision {
+		return fail(ErrRevisionConflict)
+	}
+	before := *item
+
+	if op.Op == BatchDelete {
+		if err := batch.Delete(op.ID, item.Revision, deletedBy); err != nil {
+			return nil, nil, err
+		}
+		return result, &batchChange{action: AuditDelete, before: &before}, nil
+	}
+
+	if op.Instance == nil {
+		return fail(errors.New("instance is required"))
+	}
+	if !principal.CanAccess(op.Instance) {
+		return fail(ErrOutOfScope)
+	}
+	newItem := *op.Instance
+	// the uniqueness checks must not match the instance itself
+	newItem.ID = item.ID
+	if err := c.validateInBatch(batch, &newItem); err != nil {
+		return fail(err)
+	}
+	item.configure(&newItem)
+	saved, err := batch.Save(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	result.Instance = saved
+	return result, &batchChange{action: AuditUpdate, before: &before, after: saved}, nil
+}
+
+// validateInBatch validates the instance with the uniqueness checks
+// looking at the batch, i.e. the stored instances as changed by the
+// operations before
+func (c *InstanceServiceImpl) validateInBatch(batch InstanceBatch, item *Instance) error {
+	ctx := context.WithValue(context.Background(), lookupKey{}, batch)
+	return c.validator.StructCtx(ctx, item)
+}
+
+// idTakenError tells why an ID can't be given to a new instance
+type idTakenError string
+
+func (e idTakenError) Error() string {
+	return string(e)
+}
+
+// checkNewID returns an idTakenError unless the ID is valid and unused,
+// by stored as well as by trashed instances
+func checkNewID(batch InstanceBatch, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return idTakenError("invalid id '" + id + "'")
+	}
+	item, err := batch.FindOne(id)
+	if err != nil {
+		return err
+	}
+	if item != nil {
+		return idTakenError("id '" + id + "' is taken")
+	}
+	trashed, err := batch.InTrash(id)
+	if err != nil {
+		return err
+	}
+	if trashed {
+		return idTakenError("id '" + id + "' is taken by an instance in the trash")
+	}
+	return nil
+}
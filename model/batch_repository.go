@@ -0,0 +1,52 @@
+package model
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+func (r *BoltInstanceRepository) Batch(fn func(batch InstanceBatch) error) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltInstanceBatch{tx})
+	})
+}
+
+// boltInstanceBatch works on the write transaction of a batch. The
+// repository itself must not be used meanwhile, bolt would deadlock.
+type boltInstanceBatch struct {
+	tx *bolt.Tx
+}
+
+func (b *boltInstanceBatch) FindOne(id string) (*Instance, error) {
+	return getInstance(b.tx, id)
+}
+
+func (b *boltInstanceBatch) InTrash(id string) (bool, error) {
+	return len(b.tx.Bucket(instanceTrashBucket).Get([]byte(id))) > 0, nil
+}
+
+func (b *boltInstanceBatch) FindTrashed(id string) (*TrashedInstance, error) {
+	return getTrashed(b.tx, []byte(id))
+}
+
+func (b *boltInstanceBatch) FindByIPAddress(IPAddress string) (*Instance, error) {
+	return findByIndex(b.tx, ipAddressIndex, ipKey(IPAddress))
+}
+
+func (b *boltInstanceBatch) FindByMACAddress(MACAddress string) (*Instance, error) {
+	return findByIndex(b.tx, macAddressIndex, macKey(MACAddress))
+}
+
+func (b *boltInstanceBatch) Save(item *Instance) (*Instance, error) {
+	if err := saveInstance(b.tx, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (b *boltInstanceBatch) Delete(id string, revision uint64, deletedBy string) error {
+	return deleteInstance(b.tx, id, revision, deletedBy)
+}
+
+func (b *boltInstanceBatch) Undelete(id string) (*Instance, error) {
+	return undeleteInstance(b.tx, id)
+}
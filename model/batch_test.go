@@ -0,0 +1,51 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+func TestInstanceBatch(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	service := NewInstanceService(NewInstanceRepository(db), nil, validator.New())
+	principal := &Principal{}
+
+	web1, err := service.Create(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"}, nil)
+	assert.Nil(t, err)
+
+	// the second create takes the address the first one takes as well
+	ops := []BatchOperation{
+		{Op: BatchCreate, Instance: &Instance{Name: "web2", IPAddress: "10.0.0.2", MACAddress: "00:00:00:00:00:02"}},
+		{Op: BatchCreate, Instance: &Instance{Name: "web3", IPAddress: "10.0.0.2", MACAddress: "00:00:00:00:00:03"}},
+	}
+	results, err := service.Batch(ops, BatchOptions{Atomic: true}, principal, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrBatchRolledBack, results[0].Err)
+	assert.IsType(t, validator.ValidationErrors{}, results[1].Err)
+	items, err := service.FindAll()
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	// moving web1 away frees its address within the batch
+	ops = []BatchOperation{
+		{Op: BatchUpdate, ID: web1.ID.Hex(), Instance: &Instance{Name: "web1", IPAddress: "10.0.0.9", MACAddress: "00:00:00:00:00:01"}},
+		{Op: BatchCreate, Instance: &Instance{Name: "web2", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:02"}},
+		{Op: BatchDelete, ID: web1.ID.Hex(), Revision: web1.Revision},
+		{Op: BatchDelete, ID: "unknown"},
+	}
+	results, err = service.Batch(ops, BatchOptions{}, principal, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, results[0].Err)
+	assert.Nil(t, results[1].Err)
+	assert.Equal(t, ErrRevisionConflict, results[2].Err)
+	assert.Equal(t, ErrInstanceNotFound, results[3].Err)
+	item, err := service.FindOne(web1.ID.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.9", item.IPAddress)
+	item, err = service.Repository.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "web2", item.Name)
+}
@@ -0,0 +1,408 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// BundleVersion is the version of the bundle format written by Export.
+// Import reads bundles up to this version.
+const BundleVersion = 1
+
+// Bundle is the declarative configuration of cloud-initer: the
+// environment and the instances without their provisioning state. API
+// tokens, revisions and the logs aren't part of it.
+type Bundle struct {
+	Version     int                `json:"version"`
+	ExportedAt  time.Time          `json:"exportedAt"`
+	Environment *BundleEnvironment `json:"environment,omitempty"`
+	Instances   []BundleInstance   `json:"instances"`
+}
+
+type BundleEnvironment struct {
+	Config string `json:"config"`
+}
+
+type BundleInstance struct {
+	ID         string            `json:"id,omitempty"`
+	Name       string            `json:"name"`
+	IPAddress  string            `json:"ipAddress"`
+	MACAddress string            `json:"macAddress"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	UserData   string            `json:"userData,omitempty"`
+	MetaData   string            `json:"metaData,omitempty"`
+	// Delivery is nil for the default policy
+	Delivery *DeliveryPolicy `json:"delivery,omitempty"`
+}
+
+func newBundleInstance(item *Instance) BundleInstance {
+	b := BundleInstance{
+		ID:         item.ID.Hex(),
+		Name:       item.Name,
+		IPAddress:  item.IPAddress,
+		MACAddress: item.MACAddress,
+		Labels:     item.Labels,
+		UserData:   item.UserData,
+		MetaData:   item.MetaData,
+	}
+	if len(b.Labels) == 0 {
+		b.Labels = nil
+	}
+	if item.Delivery != (DeliveryPolicy{}) {
+		delivery := item.Delivery
+		b.Delivery = &delivery
+	}
+	return b
+}
+
+func (b *BundleInstance) instance() *Instance {
+	item := &Instance{
+		Name:       b.Name,
+		IPAddress:  b.IPAddress,
+		MACAddress: b.MACAddress,
+		Labels:     b.Labels,
+		UserData:   b.UserData,
+		MetaData:   b.MetaData,
+	}
+	if b.Delivery != nil {
+		item.Delivery = *b.Delivery
+	}
+	return item
+}
+
+// BundleFormat is the encoding of a bundle
+type BundleFormat string
+
+const (
+	BundleYAML BundleFormat = "yaml"
+	BundleJSON BundleFormat = "json"
+)
+
+// Encode writes the bundle as YAML, where templates stay readable as
+// block scalars, or as indented JSON
+func (b *Bundle) Encode(format BundleFormat) ([]byte, error) {
+	enc, err := json.MarshalIndent(b, "", "  ")
+	if err != nil || format == BundleJSON {
+		return append(enc, '\n'), err
+	}
+	if format != BundleYAML {
+		return nil, errors.Errorf("unknown format '%s'", format)
+	}
+	// JSON is YAML, decoding it into a MapSlice keeps the field order
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(enc, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// DecodeBundle reads a bundle in either format and checks its version
+func DecodeBundle(data []byte) (*Bundle, error) {
+	bundle := new(Bundle)
+	if err := decodeYAML(data, bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Version == 0 {
+		return nil, errors.New("the bundle has no version")
+	}
+	if bundle.Version > BundleVersion {
+		return nil, errors.Errorf("bundle version %d is newer than the supported version %d", bundle.Version, BundleVersion)
+	}
+	return bundle, nil
+}
+
+// decodeYAML decodes YAML, or JSON, into v by the JSON field names
+func decodeYAML(data []byte, v interface{}) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	enc, err := json.Marshal(jsonValue(doc))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(enc, v)
+}
+
+// jsonValue turns the maps decoded from YAML into maps JSON can encode
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// ImportOptions control how a bundle is imported
+type ImportOptions struct {
+	// DryRun validates the bundle and reports the changes without
+	// making them
+	DryRun bool
+	// Prune deletes the instances that aren't in the bundle
+	Prune bool
+	// PreserveIDs creates new instances with the IDs from the bundle
+	// instead of new ones
+	PreserveIDs bool
+}
+
+// ImportChange is a change an import makes, with a diff of the bundle
+// representations. Err tells why it can't be made.
+type ImportChange struct {
+	Action   AuditAction `json:"action"`
+	Resource string      `json:"resource"`
+	ID       string      `json:"id,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Diff     string      `json:"diff"`
+	Err      error       `json:"-"`
+}
+
+type ImportResult struct {
+	DryRun  bool           `json:"dryRun"`
+	Applied bool           `json:"applied"`
+	Changes []ImportChange `json:"changes"`
+}
+
+// Failed returns the changes that can't be made
+func (r *ImportResult) Failed() []ImportChange {
+	failed := []ImportChange{}
+	for _, change := range r.Changes {
+		if change.Err != nil {
+			failed = append(failed, change)
+		}
+	}
+	return failed
+}
+
+type BundleService interface {
+	Export() (*Bundle, error)
+	// Import makes the stored configuration match the bundle. Instances
+	// are matched by ID, or by name when the bundle has no ID for them
+	// and the name is unique. The instances are changed in a single
+	// transaction, nothing is changed when any change fails.
+	Import(bundle *Bundle, options ImportOptions, actor *Actor) (*ImportResult, error)
+}
+
+type BundleServiceImpl struct {
+	InstanceService    InstanceService
+	EnvironmentService EnvironmentService
+}
+
+func NewBundleService(instanceService InstanceService, environmentService EnvironmentService) *BundleServiceImpl {
+	service := &BundleServiceImpl{
+		InstanceService:    instanceService,
+		EnvironmentService: environmentService,
+	}
+	return service
+}
+
+func (c *BundleServiceImpl) Export() (*Bundle, error) {
+	env, err := c.EnvironmentService.GetEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	items, _, err := c.InstanceService.FindPage(&InstanceQuery{Sort: SortByName})
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{
+		Version:     BundleVersion,
+		ExportedAt:  time.Now().UTC(),
+		Environment: &BundleEnvironment{Config: env.Config},
+		Instances:   []BundleInstance{},
+	}
+	for i := range items {
+		bundle.Instances = append(bundle.Instances, newBundleInstance(&items[i]))
+	}
+	return bundle, nil
+}
+
+func (c *BundleServiceImpl) Import(bundle *Bundle, options ImportOptions, actor *Actor) (*ImportResult, error) {
+	if bundle.Version == 0 || bundle.Version > BundleVersion {
+		return nil, errors.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+	result := &ImportResult{DryRun: options.DryRun, Changes: []ImportChange{}}
+
+	ops, changes, err := c.planInstances(bundle, options)
+	if err != nil {
+		return nil, err
+	}
+	envChange, err := c.planEnvironment(bundle)
+	if err != nil {
+		return nil, err
+	}
+	// an invalid environment fails the import, the batch still reports
+	// the failing instances then
+	dryRun := options.DryRun || (envChange != nil && envChange.Err != nil)
+	if len(ops) > 0 {
+		results, err := c.InstanceService.Batch(ops, BatchOptions{Atomic: true, DryRun: dryRun}, &Principal{}, actor)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			if results[i].Err != ErrBatchRolledBack {
+				changes[i].Err = results[i].Err
+			}
+		}
+	}
+	result.Changes = append(result.Changes, changes...)
+	if envChange != nil {
+		result.Changes = append(result.Changes, *envChange)
+	}
+	if dryRun || len(result.Failed()) > 0 {
+		return result, nil
+	}
+	// the environment can't be part of the transaction, it was validated
+	// beforehand and is changed last
+	if envChange != nil {
+		_, err := c.EnvironmentService.Update(&Environment{Config: bundle.Environment.Config}, actor)
+		if err != nil {
+			return nil, errors.Wrap(err, "the instances were imported, updating the environment failed")
+		}
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// plannedChange is an operation of an import with the change it makes
+type plannedChange struct {
+	op     BatchOperation
+	change ImportChange
+}
+
+// planOrder runs deletes before updates before creates, so addresses
+// freed by an operation can be taken by the ones after it
+var planOrder = map[BatchOp]int{BatchDelete: 0, BatchUpdate: 1, BatchCreate: 2}
+
+// planInstances returns the batch operations making the stored instances
+// match the bundle, along with the change each of them makes
+func (c *BundleServiceImpl) planInstances(bundle *Bundle, options ImportOptions) ([]BatchOperation, []ImportChange, error) {
+	items, err := c.InstanceService.FindAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[string]*Instance)
+	byName := make(map[string][]*Instance)
+	for i := range items {
+		byID[items[i].ID.Hex()] = &items[i]
+		byName[items[i].Name] = append(byName[items[i].Name], &items[i])
+	}
+
+	var planned []plannedChange
+	matched := make(map[string]bool)
+	for i := range bundle.Instances {
+		want := bundle.Instances[i]
+		var item *Instance
+		if want.ID != "" {
+			item = byID[want.ID]
+		} else if named := byName[want.Name]; len(named) == 1 {
+			item = named[0]
+		} else if len(named) > 1 {
+			return nil, nil, errors.Errorf("instance %s has no ID and its name isn't unique", want.Name)
+		}
+
+		if item == nil {
+			op := BatchOperation{Op: BatchCreate, Instance: want.instance()}
+			if options.PreserveIDs {
+				op.ID = want.ID
+			}
+			want.ID = op.ID
+			diff, err := Diff(nil, want)
+			if err != nil {
+				return nil, nil, err
+			}
+			planned = append(planned, plannedChange{op, ImportChange{Action: AuditCreate, Resource: ResourceInstance, ID: op.ID, Name: want.Name, Diff: diff}})
+			continue
+		}
+
+		id := item.ID.Hex()
+		if matched[id] {
+			return nil, nil, errors.Errorf("instance %s is in the bundle twice", id)
+		}
+		matched[id] = true
+		have := newBundleInstance(item)
+		want.ID = id
+		if len(want.Labels) == 0 {
+			want.Labels = nil
+		}
+		if want.Delivery != nil && *want.Delivery == (DeliveryPolicy{}) {
+			want.Delivery = nil
+		}
+		if reflect.DeepEqual(have, want) {
+			continue
+		}
+		diff, err := Diff(have, want)
+		if err != nil {
+			return nil, nil, err
+		}
+		planned = append(planned, plannedChange{
+			BatchOperation{Op: BatchUpdate, ID: id, Revision: item.Revision, Instance: want.instance()},
+			ImportChange{Action: AuditUpdate, Resource: ResourceInstance, ID: id, Name: item.Name, Diff: diff},
+		})
+	}
+
+	if options.Prune {
+		for i := range items {
+			id := items[i].ID.Hex()
+			if matched[id] {
+				continue
+			}
+			diff, err := Diff(newBundleInstance(&items[i]), nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			planned = append(planned, plannedChange{
+				BatchOperation{Op: BatchDelete, ID: id, Revision: items[i].Revision},
+				ImportChange{Action: AuditDelete, Resource: ResourceInstance, ID: id, Name: items[i].Name, Diff: diff},
+			})
+		}
+	}
+	sort.SliceStable(planned, func(i, j int) bool {
+		return planOrder[planned[i].op.Op] < planOrder[planned[j].op.Op]
+	})
+	ops := make([]BatchOperation, len(planned))
+	changes := make([]ImportChange, len(planned))
+	for i := range planned {
+		ops[i], changes[i] = planned[i].op, planned[i].change
+	}
+	return ops, changes, nil
+}
+
+// planEnvironment returns the change of the environment, nil when the
+// bundle has none or it's the same
+func (c *BundleServiceImpl) planEnvironment(bundle *Bundle) (*ImportChange, error) {
+	if bundle.Environment == nil {
+		return nil, nil
+	}
+	env, err := c.EnvironmentService.GetEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	if env.Config == bundle.Environment.Config {
+		return nil, nil
+	}
+	diff, err := Diff(&BundleEnvironment{Config: env.Config}, bundle.Environment)
+	if err != nil {
+		return nil, err
+	}
+	change := &ImportChange{Action: AuditUpdate, Resource: ResourceEnvironment, Diff: diff}
+	if _, err := (&Environment{Config: bundle.Environment.Config}).decodeConfig(); err != nil {
+		change.Err = errors.Wrap(err, "config is not valid YAML")
+	}
+	return change, nil
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+func TestBundleImport(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	v := validator.New()
+	instances := NewInstanceService(NewInstanceRepository(db), nil, v)
+	service := NewBundleService(instances, NewEnvironmentService(NewEnvironmentRepository(db), nil, v))
+
+	web1, err := instances.Create(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"}, nil)
+	assert.Nil(t, err)
+	_, err = instances.Create(&Instance{Name: "web2", IPAddress: "10.0.0.2", MACAddress: "00:00:00:00:00:02"}, nil)
+	assert.Nil(t, err)
+
+	bundle, err := service.Export()
+	assert.Nil(t, err)
+	enc, err := bundle.Encode(BundleYAML)
+	assert.Nil(t, err)
+	bundle, err = DecodeBundle(enc)
+	assert.Nil(t, err)
+	assert.Len(t, bundle.Instances, 2)
+
+	// web1 is matched by name, web2 is pruned and web3 takes its address
+	bundle.Instances = []BundleInstance{
+		{Name: "web1", IPAddress: "10.0.0.9", MACAddress: "00:00:00:00:00:01"},
+		{ID: "0123456789abcdef01234567", Name: "web3", IPAddress: "10.0.0.2", MACAddress: "00:00:00:00:00:03"},
+	}
+	options := ImportOptions{DryRun: true, Prune: true, PreserveIDs: true}
+	result, err := service.Import(bundle, options, nil)
+	assert.Nil(t, err)
+	assert.False(t, result.Applied)
+	assert.Len(t, result.Changes, 3)
+	assert.Empty(t, result.Failed())
+	item, err := instances.FindOne(web1.ID.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", item.IPAddress)
+
+	options.DryRun = false
+	result, err = service.Import(bundle, options, nil)
+	assert.Nil(t, err)
+	assert.True(t, result.Applied)
+	items, err := instances.FindAll()
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	item, err = instances.FindOne("0123456789abcdef01234567")
+	assert.Nil(t, err)
+	assert.Equal(t, "web3", item.Name)
+
+	result, err = service.Import(bundle, options, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, result.Changes)
+
+	_, err = DecodeBundle([]byte("version: 2\n"))
+	assert.NotNil(t, err)
+}
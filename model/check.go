@@ -0,0 +1,451 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// quarantineBucket receives the records a repair takes out of the way,
+// in a nested bucket per bucket they came from, so they can still be
+// inspected and fixed by hand
+var quarantineBucket = []byte("quarantine")
+
+// ProblemKind tells what's wrong with the database
+type ProblemKind string
+
+const (
+	// ProblemUndecodable is a record that isn't valid JSON for its type
+	ProblemUndecodable ProblemKind = "undecodable"
+	// ProblemDuplicateIP and ProblemDuplicateMAC are instances sharing an
+	// address, guests can't be told apart then
+	ProblemDuplicateIP  ProblemKind = "duplicate-ip"
+	ProblemDuplicateMAC ProblemKind = "duplicate-mac"
+	// ProblemDangling is a record of an instance that no longer exists
+	ProblemDangling ProblemKind = "dangling"
+	// ProblemOrphanedIndex is an index entry pointing nowhere, or to an
+	// instance with another value
+	ProblemOrphanedIndex ProblemKind = "orphaned-index"
+	// ProblemMissingIndex is an instance missing from an index
+	ProblemMissingIndex ProblemKind = "missing-index"
+)
+
+// Problem is an inconsistency found in the database
+type Problem struct {
+	Kind    ProblemKind `json:"kind"`
+	Bucket  string      `json:"bucket"`
+	Key     string      `json:"key"`
+	Message string      `json:"message"`
+	// Repaired tells whether a repair fixed it, duplicates have to be
+	// resolved by hand
+	Repaired bool `json:"repaired"`
+}
+
+// CheckReport lists the problems found
+type CheckReport struct {
+	Records  int       `json:"records"`
+	Problems []Problem `json:"problems"`
+}
+
+// Unrepaired returns the problems left
+func (r *CheckReport) Unrepaired() []Problem {
+	var problems []Problem
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// CheckDB walks the buckets and reports undecodable records, duplicate
+// addresses, records of instances that no longer exist and index entries
+// out of line with the instances. A repair moves undecodable and
+// dangling records to the quarantine bucket and rebuilds the index
+// entries, all in a single transaction. instances is the repository of
+// a storage driver keeping the instances outside the Bolt database, nil
+// for the bolt driver. Events and fetches of its instances are known
+// then.
+func CheckDB(db *bolt.DB, instances InstanceRepository, repair bool) (*CheckReport, error) {
+	c := &checker{report: &CheckReport{Problems: []Problem{}}, repair: repair, known: make(map[string]bool)}
+	if instances != nil {
+		if err := c.knowStored(instances); err != nil {
+			return nil, errors.Wrap(err, "listing the instances")
+		}
+	}
+	check := func(tx *bolt.Tx) error {
+		c.tx = tx
+		return c.run()
+	}
+	var err error
+	if repair {
+		err = db.Update(check)
+	} else {
+		err = db.View(check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	tx     *bolt.Tx
+	repair bool
+	report *CheckReport
+	// known holds the IDs of the live, trashed and quarantined instances,
+	// in Bolt or the storage driver, their records aren't taken for
+	// dangling. Quarantined instances keep
+	// their revisions, the last good one can be restored from there.
+	known map[string]bool
+	// instances holds the live instances that decode
+	instances []*Instance
+}
+
+// knowStored takes the live and trashed instances of a storage driver
+// for known
+func (c *checker) knowStored(instances InstanceRepository) error {
+	items, err := instances.FindAll()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		c.known[item.ID.Hex()] = true
+	}
+	trash, err := instances.FindTrash()
+	if err != nil {
+		return err
+	}
+	for _, item := range trash {
+		c.known[item.Instance.ID.Hex()] = true
+	}
+	return nil
+}
+
+func (c *checker) run() error {
+	if q := c.tx.Bucket(quarantineBucket); q != nil {
+		for _, name := range [][]byte{instanceBucket, instanceTrashBucket} {
+			if b := q.Bucket(name); b != nil {
+				keys, _ := records(b)
+				for _, k := range keys {
+					c.known[string(k)] = true
+				}
+			}
+		}
+	}
+	steps := []func() error{
+		c.checkInstances,
+		c.checkTrash,
+		func() error { return c.checkPerInstance(instanceRevisionBucket, decodeAs(new(Instance))) },
+		func() error { return c.checkPerInstance(eventBucket, decodeAs(new(Event))) },
+		func() error { return c.checkPerInstance(fetchBucket, decodeAs(new(Fetch))) },
+		c.checkEnvironment,
+		c.checkTokens,
+		c.checkDuplicates,
+		c.checkIndexes,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeAs(v interface{}) func(data []byte) error {
+	return func(data []byte) error {
+		return json.Unmarshal(data, v)
+	}
+}
+
+func (c *checker) problem(kind ProblemKind, bucket []byte, key string, format string, args ...interface{}) *Problem {
+	c.report.Problems = append(c.report.Problems, Problem{
+		Kind:    kind,
+		Bucket:  string(bucket),
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	})
+	return &c.report.Problems[len(c.report.Problems)-1]
+}
+
+// quarantine moves a record of the bucket at path to the quarantine
+func (c *checker) quarantine(p *Problem, path [][]byte, key, value []byte) error {
+	if !c.repair {
+		return nil
+	}
+	src := c.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		src = src.Bucket(name)
+	}
+	q, err := c.tx.CreateBucketIfNotExists(quarantineBucket)
+	if err != nil {
+		return err
+	}
+	q, err = q.CreateBucketIfNotExists(path[0])
+	if err != nil {
+		return err
+	}
+	// nested records are kept under the names of their buckets
+	var qKey []byte
+	for _, name := range path[1:] {
+		qKey = append(append(qKey, name...), keySeparator)
+	}
+	if err := q.Put(append(qKey, key...), value); err != nil {
+		return err
+	}
+	if err := src.Delete(key); err != nil {
+		return err
+	}
+	p.Repaired = true
+	return nil
+}
+
+// records reads the records of a bucket, so they can be changed while
+// visiting them
+func records(b *bolt.Bucket) (keys, values [][]byte) {
+	b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return keys, values
+}
+
+func (c *checker) checkInstances() error {
+	b := c.tx.Bucket(instanceBucket)
+	if b == nil {
+		return nil
+	}
+	keys, values := records(b)
+	for i, k := range keys {
+		c.report.Records++
+		c.known[string(k)] = true
+		item, err := decode(values[i])
+		if err == nil && item.ID.Hex() != string(k) {
+			err = errors.Errorf("stored under %s", k)
+		}
+		if err != nil {
+			p := c.problem(ProblemUndecodable, instanceBucket, string(k), "instance: %s", err)
+			if err := c.quarantine(p, [][]byte{instanceBucket}, k, values[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		c.instances = append(c.instances, item)
+	}
+	return nil
+}
+
+func (c *checker) checkTrash() error {
+	b := c.tx.Bucket(instanceTrashBucket)
+	if b == nil {
+		return nil
+	}
+	keys, values := records(b)
+	for i, k := range keys {
+		c.report.Records++
+		c.known[string(k)] = true
+		var item TrashedInstance
+		if err := json.Unmarshal(values[i], &item); err != nil {
+			p := c.problem(ProblemUndecodable, instanceTrashBucket, string(k), "trashed instance: %s", err)
+			if err := c.quarantine(p, [][]byte{instanceTrashBucket}, k, values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkPerInstance checks a bucket holding a nested bucket of records
+// per instance
+func (c *checker) checkPerInstance(name []byte, decode func(v []byte) error) error {
+	b := c.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	var ids [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			ids = append(ids, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, id := range ids {
+		keys, values := records(b.Bucket(id))
+		dangling := !c.known[string(id)]
+		for i, k := range keys {
+			c.report.Records++
+			var p *Problem
+			if dangling {
+				p = c.problem(ProblemDangling, name, recordKey(id, k), "instance %s doesn't exist", id)
+			} else if err := decode(values[i]); err != nil {
+				p = c.problem(ProblemUndecodable, name, recordKey(id, k), "%s", err)
+			} else {
+				continue
+			}
+			if err := c.quarantine(p, [][]byte{name, id}, k, values[i]); err != nil {
+				return err
+			}
+		}
+		if dangling && c.repair {
+			if err := b.DeleteBucket(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recordKey shows the key of a record nested in the bucket of an
+// instance, sequence keys as numbers
+func recordKey(id, k []byte) string {
+	if len(k) == 8 {
+		return fmt.Sprintf("%s/%d", id, binary.BigEndian.Uint64(k))
+	}
+	return fmt.Sprintf("%s/%x", id, k)
+}
+
+func (c *checker) checkEnvironment() error {
+	if b := c.tx.Bucket(environmentBucket); b != nil {
+		if v := b.Get(environmentKey); v != nil {
+			c.report.Records++
+			if _, err := decodeEnvironment(v); err != nil {
+				p := c.problem(ProblemUndecodable, environmentBucket, string(environmentKey), "environment: %s", err)
+				if err := c.quarantine(p, [][]byte{environmentBucket}, environmentKey, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	b := c.tx.Bucket(environmentRevisionBucket)
+	if b == nil {
+		return nil
+	}
+	keys, values := records(b)
+	for i, k := range keys {
+		c.report.Records++
+		if _, err := decodeEnvironment(values[i]); err != nil {
+			p := c.problem(ProblemUndecodable, environmentRevisionBucket, fmt.Sprint(binary.BigEndian.Uint64(k)), "environment revision: %s", err)
+			if err := c.quarantine(p, [][]byte{environmentRevisionBucket}, k, values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTokens only names tokens by their ID, the keys are secret hashes
+func (c *checker) checkTokens() error {
+	b := c.tx.Bucket(tokenBucket)
+	if b == nil {
+		return nil
+	}
+	keys, values := records(b)
+	for i, k := range keys {
+		c.report.Records++
+		var item struct {
+			ID bson.ObjectId `json:"id"`
+		}
+		if err := json.Unmarshal(values[i], &item); err != nil {
+			p := c.problem(ProblemUndecodable, tokenBucket, "", "token: %s", err)
+			if err := c.quarantine(p, [][]byte{tokenBucket}, k, values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkDuplicates() error {
+	checks := []struct {
+		kind  ProblemKind
+		field string
+		key   func(p *Instance) []byte
+	}{
+		{ProblemDuplicateIP, "IP address", func(p *Instance) []byte { return ipKey(p.IPAddress) }},
+		{ProblemDuplicateMAC, "MAC address", func(p *Instance) []byte { return macKey(p.MACAddress) }},
+	}
+	for _, check := range checks {
+		byKey := make(map[string][]string)
+		var order []string
+		for _, item := range c.instances {
+			k := check.key(item)
+			if k == nil {
+				continue
+			}
+			if _, ok := byKey[string(k)]; !ok {
+				order = append(order, string(k))
+			}
+			byKey[string(k)] = append(byKey[string(k)], item.ID.Hex())
+		}
+		for _, k := range order {
+			ids := byKey[string(k)]
+			if len(ids) < 2 {
+				continue
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				c.problem(check.kind, instanceBucket, id, "%s shared by %s", check.field, strings.Join(ids, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// checkIndexes compares every index with the instances that decode
+func (c *checker) checkIndexes() error {
+	indexes := c.tx.Bucket(instanceIndexBucket)
+	if indexes == nil {
+		return nil
+	}
+	byID := make(map[string]*Instance)
+	for _, item := range c.instances {
+		byID[item.ID.Hex()] = item
+	}
+	for _, index := range instanceIndexes {
+		b := indexes.Bucket(index)
+		if b == nil {
+			continue
+		}
+		keys, values := records(b)
+		found := make(map[string]bool)
+		for i, k := range keys {
+			id := string(values[i])
+			item := byID[id]
+			if item != nil && bytes.Equal(item.indexKey(index), k) {
+				found[id] = true
+				continue
+			}
+			p := c.problem(ProblemOrphanedIndex, instanceIndexBucket, string(index)+"/"+id, "entry of %s index points nowhere", index)
+			if c.repair {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				p.Repaired = true
+			}
+		}
+		for _, item := range c.instances {
+			k := item.indexKey(index)
+			if k == nil || found[item.ID.Hex()] {
+				continue
+			}
+			p := c.problem(ProblemMissingIndex, instanceIndexBucket, string(index)+"/"+item.ID.Hex(), "instance missing from %s index", index)
+			if c.repair {
+				if err := b.Put(k, []byte(item.ID.Hex())); err != nil {
+					return err
+				}
+				p.Repaired = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDB(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	_, err := Migrate(db, false)
+	assert.Nil(t, err)
+	repo := NewInstanceRepository(db)
+	web1, err := repo.Save(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"})
+	assert.Nil(t, err)
+	web2, err := repo.Save(&Instance{Name: "web2", IPAddress: "10.0.0.2", MACAddress: "00:00:00:00:00:02"})
+	assert.Nil(t, err)
+
+	report, err := CheckDB(db, nil, false)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// a corrupt instance, a duplicate address bypassing the
+		// validation and events of an instance that's gone
+		if err := tx.Bucket(instanceBucket).Put([]byte(web1.ID.Hex()), []byte("{")); err != nil {
+			return err
+		}
+		web2.IPAddress = "10.0.0.1"
+		enc, err := web2.encode()
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(instanceBucket).Put([]byte(web2.ID.Hex()), enc); err != nil {
+			return err
+		}
+		events, err := tx.Bucket(eventBucket).CreateBucket([]byte("0123456789abcdef01234567"))
+		if err != nil {
+			return err
+		}
+		return events.Put(sequenceKey(1), []byte(`{}`))
+	})
+	assert.Nil(t, err)
+
+	report, err = CheckDB(db, nil, false)
+	assert.Nil(t, err)
+	kinds := make(map[ProblemKind]int)
+	for _, p := range report.Problems {
+		kinds[p.Kind]++
+	}
+	// web1's five entries and web2's old IP entry point elsewhere now, web2's
+	// new IP isn't indexed
+	assert.Equal(t, map[ProblemKind]int{
+		ProblemUndecodable:   1,
+		ProblemDangling:      1,
+		ProblemOrphanedIndex: 6,
+		ProblemMissingIndex:  1,
+	}, kinds)
+
+	report, err = CheckDB(db, nil, true)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Unrepaired())
+	report, err = CheckDB(db, nil, false)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+
+	item, err := repo.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, web2.ID, item.ID)
+	err = db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, []byte("{"), tx.Bucket(quarantineBucket).Bucket(instanceBucket).Get([]byte(web1.ID.Hex())))
+		assert.Nil(t, tx.Bucket(eventBucket).Bucket([]byte("0123456789abcdef01234567")))
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// duplicates are left to be resolved by hand
+	_, err = repo.Save(&Instance{Name: "web3", IPAddress: "10.0.0.3", MACAddress: "00:00:00:00:00:02"})
+	assert.Nil(t, err)
+	report, err = CheckDB(db, nil, true)
+	assert.Nil(t, err)
+	assert.Len(t, report.Unrepaired(), 2)
+	assert.Equal(t, ProblemDuplicateMAC, report.Problems[0].Kind)
+}
+
+// with the instances outside Bolt, their events and fetches are known
+// from the storage
+func TestCheckDBStorage(t *testing.T) {
+	for _, driver := range StorageDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, cleanup := openTestDB(t)
+			defer cleanup()
+			_, err := Migrate(db, false)
+			assert.Nil(t, err)
+			dir, err := ioutil.TempDir("", "cloud-initer")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			storage, err := OpenStorage(driver, db, filepath.Join(dir, "test.db"))
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer storage.Close()
+
+			events := NewEventRepository(db)
+			fetches := NewFetchRepository(db)
+			var ids []string
+			for i, name := range []string{"web1", "web2"} {
+				item, err := storage.Instances.Save(&Instance{Name: name, IPAddress: fmt.Sprintf("10.0.0.%d", i+1), MACAddress: fmt.Sprintf("00:00:00:00:00:0%d", i+1)})
+				assert.Nil(t, err)
+				ids = append(ids, item.ID.Hex())
+				assert.Nil(t, events.Append(item.ID.Hex(), &Event{Name: "init"}, 0))
+				assert.Nil(t, fetches.Append(item.ID.Hex(), &Fetch{Timestamp: time.Now()}, time.Now().Add(-time.Hour)))
+			}
+			assert.Nil(t, storage.Instances.Delete(ids[1], 0, "admin"))
+			assert.Nil(t, events.Append("0123456789abcdef01234567", &Event{Name: "init"}, 0))
+
+			report, err := CheckDB(db, storage.Instances, true)
+			assert.Nil(t, err)
+			if assert.Len(t, report.Problems, 1) {
+				assert.Equal(t, ProblemDangling, report.Problems[0].Kind)
+				assert.True(t, report.Problems[0].Repaired)
+			}
+			for _, id := range ids {
+				items, err := events.FindByInstance(id)
+				assert.Nil(t, err)
+				assert.Len(t, items, 1)
+				found, err := fetches.FindByInstance(id)
+				assert.Nil(t, err)
+				assert.Len(t, found, 1)
+			}
+		})
+	}
+}
@@ -1,8 +1,6 @@
 package model
 
 import (
-	"errors"
-
 	"strings"
 
 	"github.com/aymerick/raymond"
@@ -16,6 +14,12 @@ func init() {
 		}
 		return raymond.SafeString(strings.Join(lines, "\n"))
 	})
+	raymond.RegisterHelper("equal", func(a, b interface{}, options *raymond.Options) interface{} {
+		if raymond.Str(a) == raymond.Str(b) {
+			return options.Fn()
+		}
+		return options.Inverse()
+	})
 }
 
 type CloudInitData struct {
@@ -24,8 +28,10 @@ type CloudInitData struct {
 }
 
 type CloudInitService interface {
-	PreviewCloudInitData(userDataTemplate, metaDataTemplate string) (*CloudInitData, error)
-	GetCloudInitDataForClient(ipAddress, userAgent string) (*CloudInitData, error)
+	// PreviewCloudInitData renders the templates for the instance, which
+	// may be nil
+	PreviewCloudInitData(userDataTemplate, metaDataTemplate string, item *Instance) (*CloudInitData, error)
+	GetDocumentForClient(client *Client, document Document) (*Instance, string, error)
 }
 
 type CloudInitServiceImpl struct {
@@ -41,27 +47,40 @@ func NewCloudInitService(instanceService InstanceService, environmentService Env
 	return service
 }
 
-func (c *CloudInitServiceImpl) PreviewCloudInitData(userDataTemplate, metaDataTemplate string) (*CloudInitData, error) {
-	return c.newCloudInitDataFromTemplate(userDataTemplate, metaDataTemplate)
+func (c *CloudInitServiceImpl) PreviewCloudInitData(userDataTemplate, metaDataTemplate string, item *Instance) (*CloudInitData, error) {
+	return c.newCloudInitDataFromTemplate(userDataTemplate, metaDataTemplate, item)
 }
 
-func (c *CloudInitServiceImpl) GetCloudInitDataForClient(ipAddress, userAgent string) (*CloudInitData, error) {
-	item, err := c.InstanceService.FindByIPForUserAgent(ipAddress, userAgent)
+// GetDocumentForClient renders a document for the instance of the
+// client. User-data is only rendered while the instance's delivery
+// policy allows it, ErrDeliveryDenied is returned afterwards unless the
+// policy asks for a sanitized document. The instance is returned
+// whenever it was found, also along with an error.
+func (c *CloudInitServiceImpl) GetDocumentForClient(client *Client, document Document) (*Instance, string, error) {
+	item, allowed, err := c.InstanceService.FetchForClient(client, document)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	if item == nil {
-		return nil, errors.New("no instance")
+	if !allowed {
+		if item.Delivery.Expired == ExpiredSanitize {
+			return item, sanitizedUserData, nil
+		}
+		return item, "", ErrDeliveryDenied
 	}
-	return c.newCloudInitDataFromTemplate(item.UserData, item.MetaData)
-}
-
-func (c *CloudInitServiceImpl) newCloudInitDataFromTemplate(userDataTemplate, metaDataTemplate string) (*CloudInitData, error) {
-	env, err := c.EnvironmentService.GetEnvironment()
+	ctx, err := c.templateContext(item)
 	if err != nil {
-		return nil, err
+		return item, "", err
 	}
-	ctx, err := env.decodeConfig()
+	template := item.MetaData
+	if document == DocumentUserData {
+		template = item.UserData
+	}
+	content, err := renderTemplate(template, ctx)
+	return item, content, err
+}
+
+func (c *CloudInitServiceImpl) newCloudInitDataFromTemplate(userDataTemplate, metaDataTemplate string, item *Instance) (*CloudInitData, error) {
+	ctx, err := c.templateContext(item)
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +100,36 @@ func (c *CloudInitServiceImpl) newCloudInitDataFromTemplate(userDataTemplate, me
 	return cloudInitData, nil
 }
 
+// templateContext holds the environment config and, under "instance",
+// the instance the templates are rendered for, so templates can branch
+// on its labels:
+//
+//	{{#equal instance.labels.role "web"}}...{{/equal}}
+func (c *CloudInitServiceImpl) templateContext(item *Instance) (interface{}, error) {
+	env, err := c.EnvironmentService.GetEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := env.decodeConfig()
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		labels := item.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		ctx["instance"] = map[string]interface{}{
+			"id":         item.ID.Hex(),
+			"name":       item.Name,
+			"ipAddress":  item.IPAddress,
+			"macAddress": item.MACAddress,
+			"labels":     labels,
+		}
+	}
+	return ctx, nil
+}
+
 func renderTemplate(template string, ctx interface{}) (string, error) {
 	tpl, err := raymond.Parse(template)
 	if err != nil {
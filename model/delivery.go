@@ -0,0 +1,93 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+// Document is one of the files served to cloud-init
+type Document string
+
+const (
+	DocumentUserData Document = "user-data"
+	DocumentMetaData Document = "meta-data"
+)
+
+// DeliveryMode controls how often an instance's user-data is served
+type DeliveryMode string
+
+const (
+	// DeliveryAlways serves the user-data on every request
+	DeliveryAlways DeliveryMode = "always"
+	// DeliveryOnce serves the user-data a single time
+	DeliveryOnce DeliveryMode = "once"
+	// DeliveryCount serves the user-data MaxFetches times
+	DeliveryCount DeliveryMode = "count"
+	// DeliveryWindow serves the user-data for Window seconds after the
+	// instance has been armed
+	DeliveryWindow DeliveryMode = "window"
+)
+
+// ExpiredAction is what guests get once the policy doesn't allow
+// serving the user-data anymore
+type ExpiredAction string
+
+const (
+	ExpiredDeny     ExpiredAction = "deny"
+	ExpiredSanitize ExpiredAction = "sanitize"
+)
+
+// sanitizedUserData is a valid user-data document that does nothing
+const sanitizedUserData = "#cloud-config\n{}\n"
+
+var ErrDeliveryDenied = errors.New("user-data is no longer available")
+
+// DeliveryPolicy limits how long secrets in the user-data stay
+// fetchable. Arming an instance resets its fetch counter and opens the
+// provisioning window.
+type DeliveryPolicy struct {
+	Mode       DeliveryMode  `json:"mode" validate:"deliveryPolicy"`
+	MaxFetches int           `json:"maxFetches,omitempty"`
+	Window     int           `json:"window,omitempty"`
+	Expired    ExpiredAction `json:"expired,omitempty"`
+}
+
+// Allows reports whether the user-data may be served to the instance
+// given the fetches made so far
+func (p *DeliveryPolicy) Allows(item *Instance, now time.Time) bool {
+	switch p.Mode {
+	case DeliveryOnce:
+		return item.UserDataFetches < 1
+	case DeliveryCount:
+		return item.UserDataFetches < p.MaxFetches
+	case DeliveryWindow:
+		if item.ArmedAt.IsZero() {
+			return false
+		}
+		return now.Before(item.ArmedAt.Add(time.Duration(p.Window) * time.Second))
+	}
+	return true
+}
+
+func validateDeliveryPolicy(fl validator.FieldLevel) bool {
+	policy, ok := fl.Parent().Interface().(DeliveryPolicy)
+	if !ok {
+		return false
+	}
+	switch policy.Expired {
+	case "", ExpiredDeny, ExpiredSanitize:
+	default:
+		return false
+	}
+	switch policy.Mode {
+	case "", DeliveryAlways, DeliveryOnce:
+		return true
+	case DeliveryCount:
+		return policy.MaxFetches > 0
+	case DeliveryWindow:
+		return policy.Window > 0
+	}
+	return false
+}
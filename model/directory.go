@@ -0,0 +1,441 @@
+package model
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aymerick/raymond"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrReadOnly is returned for changes to the configuration while it's
+// read from a directory
+var ErrReadOnly = errors.New("the configuration is read from a directory and can't be changed here")
+
+// the layout of a configuration directory
+const (
+	environmentFile = "environment.yaml"
+	instancesDir    = "instances"
+	templatesDir    = "templates"
+)
+
+// reloadDelay collects the events of an editor or a git checkout
+// touching several files into a single reload
+const reloadDelay = 250 * time.Millisecond
+
+// instanceFile is an instance as written in the instances directory.
+// The user-data and meta-data can be kept in files of the templates
+// directory instead.
+type instanceFile struct {
+	BundleInstance
+	UserDataTemplate string `json:"userDataTemplate"`
+	MetaDataTemplate string `json:"metaDataTemplate"`
+}
+
+// DirectoryStatus tells which state of the directory is served
+type DirectoryStatus struct {
+	Dir string `json:"dir"`
+	// Generation counts the states loaded
+	Generation int       `json:"generation"`
+	LoadedAt   time.Time `json:"loadedAt"`
+	// Error is why the directory failed to load since, the last good
+	// state is kept meanwhile
+	Error    string     `json:"error,omitempty"`
+	FailedAt *time.Time `json:"failedAt,omitempty"`
+}
+
+// DirectorySource holds the configuration read from a directory tree:
+//
+//	environment.yaml     the environment config
+//	instances/*.yaml     an instance or a list of instances per file
+//	templates/...        user-data and meta-data referenced by instances
+//
+// Instances without an ID get one derived from their name. Whenever the
+// tree changes, it's loaded and validated as a whole and replaces the
+// served state at once. Errors keep the last good state. The runtime
+// state of the instances, e.g. their status, is kept in memory only.
+type DirectorySource struct {
+	dir       string
+	validator *validator.Validate
+	log       *logrus.Entry
+
+	mu     sync.RWMutex
+	state  *directoryState
+	status DirectoryStatus
+}
+
+// directoryState is a loaded configuration. It's only changed under the
+// write lock of the source.
+type directoryState struct {
+	environment Environment
+	instances   map[string]*Instance
+	// ipKey and macKey to instance ID
+	byIP  map[string]string
+	byMAC map[string]string
+}
+
+// NewDirectorySource loads the directory, failing unless it's valid
+func NewDirectorySource(dir string) (*DirectorySource, error) {
+	source := &DirectorySource{
+		dir: dir,
+		log: logrus.WithField("component", "directory"),
+		// validates instances like the API does, the uniqueness checks
+		// look at the state being loaded
+		validator: validator.New(),
+	}
+	NewInstanceService(nil, nil, source.validator)
+	// errors name the fields as they're written in the files
+	source.validator.RegisterTagNameFunc(func(field reflect.StructField) string {
+		return strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	})
+	source.status.Dir = dir
+	if err := source.Reload(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Status reports the state served and the last error
+func (s *DirectorySource) Status() DirectoryStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// Reload loads the directory and serves it unless it's invalid
+func (s *DirectorySource) Reload() error {
+	state, err := s.load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		now := time.Now()
+		s.status.Error = err.Error()
+		s.status.FailedAt = &now
+		return err
+	}
+	state.takeOver(s.state, time.Now())
+	s.state = state
+	s.status.Generation++
+	s.status.LoadedAt = time.Now()
+	s.status.Error = ""
+	s.status.FailedAt = nil
+	return nil
+}
+
+// Watch reloads the directory on changes until done is closed
+func (s *DirectorySource) Watch(done <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := s.watchDirs(watcher); err != nil {
+		return err
+	}
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Chmod == event.Op {
+				continue
+			}
+			reload = time.After(reloadDelay)
+		case err := <-watcher.Errors:
+			s.log.WithError(err).Error("Watching the configuration failed")
+		case <-reload:
+			reload = nil
+			// directories may have been added
+			if err := s.watchDirs(watcher); err != nil {
+				s.log.WithError(err).Error("Watching the configuration failed")
+			}
+			if err := s.Reload(); err != nil {
+				s.log.WithError(err).Error("Invalid configuration, keeping the last good one")
+				continue
+			}
+			s.log.Infof("Loaded configuration generation %d", s.Status().Generation)
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func (s *DirectorySource) watchDirs(watcher *fsnotify.Watcher) error {
+	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != s.dir {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// load reads and validates the directory
+func (s *DirectorySource) load() (*directoryState, error) {
+	state := &directoryState{
+		instances: make(map[string]*Instance),
+		byIP:      make(map[string]string),
+		byMAC:     make(map[string]string),
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(s.dir, environmentFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	state.environment = Environment{Config: string(config)}
+	if _, err := state.environment.decodeConfig(); err != nil {
+		return nil, errors.Wrapf(err, "%s is not valid YAML", environmentFile)
+	}
+
+	files, err := s.instanceFiles()
+	if err != nil {
+		return nil, err
+	}
+	read := make(map[string][]*Instance)
+	for _, file := range files {
+		items, err := s.readInstances(file)
+		if err != nil {
+			return nil, errors.Wrap(err, s.relative(file))
+		}
+		for _, item := range items {
+			if err := state.add(item); err != nil {
+				return nil, errors.Wrapf(err, "%s: %s", s.relative(file), item.Name)
+			}
+		}
+		read[file] = items
+	}
+	// validate once all are known, so the uniqueness checks see them all
+	for _, file := range files {
+		for _, item := range read[file] {
+			if err := s.validator.StructCtx(state.lookupContext(), item); err != nil {
+				return nil, errors.Wrapf(validationError(err), "%s: %s", s.relative(file), item.Name)
+			}
+		}
+	}
+	return state, nil
+}
+
+// instanceFiles lists the YAML and JSON files below the instances
+// directory in a stable order
+func (s *DirectorySource) instanceFiles() ([]string, error) {
+	var files []string
+	root := filepath.Join(s.dir, instancesDir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			if !info.IsDir() {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// readInstances reads a file holding an instance or a list of them
+func (s *DirectorySource) readInstances(file string) ([]*Instance, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var list []instanceFile
+	if err := decodeYAML(data, &list); err != nil {
+		var single instanceFile
+		if err := decodeYAML(data, &single); err != nil {
+			return nil, err
+		}
+		list = []instanceFile{single}
+	}
+
+	items := []*Instance{}
+	for i := range list {
+		item, err := s.instance(&list[i])
+		if err != nil {
+			return nil, errors.Wrap(err, list[i].Name)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *DirectorySource) instance(f *instanceFile) (*Instance, error) {
+	item := f.instance()
+	switch {
+	case f.ID == "":
+		// stays the same as long as the name does
+		sum := sha1.Sum([]byte(f.Name))
+		item.ID = bson.ObjectId(sum[:12])
+	case bson.IsObjectIdHex(f.ID):
+		item.ID = bson.ObjectIdHex(f.ID)
+	default:
+		return nil, errors.Errorf("invalid id '%s'", f.ID)
+	}
+	var err error
+	if f.UserDataTemplate != "" {
+		if item.UserData, err = s.template(f.UserDataTemplate); err != nil {
+			return nil, err
+		}
+	}
+	if f.MetaDataTemplate != "" {
+		if item.MetaData, err = s.template(f.MetaDataTemplate); err != nil {
+			return nil, err
+		}
+	}
+	for _, template := range []string{item.UserData, item.MetaData} {
+		if _, err := raymond.Parse(template); err != nil {
+			return nil, errors.Wrap(err, "invalid template")
+		}
+	}
+	return item, nil
+}
+
+// template reads a file of the templates directory
+func (s *DirectorySource) template(name string) (string, error) {
+	root := filepath.Join(s.dir, templatesDir)
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", errors.Errorf("template '%s' is outside of %s", name, templatesDir)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (s *DirectorySource) relative(path string) string {
+	if rel, err := filepath.Rel(s.dir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// validationError lists the fields failing validation
+func validationError(err error) error {
+	errs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+	var fields []string
+	for _, e := range errs {
+		if strings.HasPrefix(e.Tag(), "unique") {
+			fields = append(fields, fmt.Sprintf("%s '%v' is taken", e.Field(), e.Value()))
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s '%v' failed the %s check", e.Field(), e.Value(), e.Tag()))
+	}
+	return errors.New(strings.Join(fields, ", "))
+}
+
+func (s *directoryState) add(item *Instance) error {
+	id := item.ID.Hex()
+	if _, ok := s.instances[id]; ok {
+		return errors.Errorf("id %s is taken", id)
+	}
+	s.instances[id] = item
+	// duplicates are reported by the validation
+	if _, ok := s.byIP[string(ipKey(item.IPAddress))]; !ok {
+		s.byIP[string(ipKey(item.IPAddress))] = id
+	}
+	if _, ok := s.byMAC[string(macKey(item.MACAddress))]; !ok {
+		s.byMAC[string(macKey(item.MACAddress))] = id
+	}
+	return nil
+}
+
+// takeOver carries the runtime state of the instances over from the
+// previous state. Revisions only change along with the configuration.
+func (s *directoryState) takeOver(previous *directoryState, now time.Time) {
+	s.environment.UpdatedAt = now
+	s.environment.Revision = 1
+	if previous != nil && s.environment.Config == previous.environment.Config {
+		s.environment.UpdatedAt = previous.environment.UpdatedAt
+		s.environment.Revision = previous.environment.Revision
+	} else if previous != nil {
+		s.environment.Revision = previous.environment.Revision + 1
+	}
+
+	for id, item := range s.instances {
+		var old *Instance
+		if previous != nil {
+			old = previous.instances[id]
+		}
+		if old == nil {
+			item.setStatus(StatusPending, now)
+			item.CreatedAt, item.UpdatedAt = now, now
+			item.Revision = 1
+			continue
+		}
+		config := *item
+		*item = *old
+		if !reflect.DeepEqual(newBundleInstance(old), newBundleInstance(&config)) {
+			item.configure(&config)
+			item.Revision++
+		}
+	}
+}
+
+func (s *directoryState) FindByIPAddress(IPAddress string) (*Instance, error) {
+	return s.find(s.byIP[string(ipKey(IPAddress))]), nil
+}
+
+func (s *directoryState) FindByMACAddress(MACAddress string) (*Instance, error) {
+	key := macKey(MACAddress)
+	if key == nil {
+		return nil, nil
+	}
+	return s.find(s.byMAC[string(key)]), nil
+}
+
+// lookupContext makes the uniqueness checks of the validation look at
+// this state
+func (s *directoryState) lookupContext() context.Context {
+	return context.WithValue(context.Background(), lookupKey{}, s)
+}
+
+// find returns a copy of the instance, nil for unknown IDs
+func (s *directoryState) find(id string) *Instance {
+	item, ok := s.instances[id]
+	if !ok {
+		return nil
+	}
+	copy := *item
+	return &copy
+}
+
+// all returns copies of the instances
+func (s *directoryState) all() []Instance {
+	items := make([]Instance, 0, len(s.instances))
+	for _, item := range s.instances {
+		items = append(items, *item)
+	}
+	return items
+}
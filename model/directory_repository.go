@@ -0,0 +1,152 @@
+package model
+
+import (
+	"reflect"
+	"time"
+)
+
+// DirInstanceRepository serves the instances of a DirectorySource. Their
+// configuration can't be changed, only their runtime state.
+type DirInstanceRepository struct {
+	source *DirectorySource
+}
+
+func NewDirInstanceRepository(source *DirectorySource) *DirInstanceRepository {
+	return &DirInstanceRepository{source}
+}
+
+func (r *DirInstanceRepository) FindAll() ([]Instance, error) {
+	r.source.mu.RLock()
+	defer r.source.mu.RUnlock()
+	return r.source.state.all(), nil
+}
+
+func (r *DirInstanceRepository) FindOne(id string) (*Instance, error) {
+	r.source.mu.RLock()
+	defer r.source.mu.RUnlock()
+	return r.source.state.find(id), nil
+}
+
+func (r *DirInstanceRepository) FindPage(query *InstanceQuery) ([]Instance, int, error) {
+	r.source.mu.RLock()
+	defer r.source.mu.RUnlock()
+	items, total := findPage(r.source.state.all(), query)
+	return items, total, nil
+}
+
+func (r *DirInstanceRepository) FindByIPAddress(IPAddress string) (*Instance, error) {
+	r.source.mu.RLock()
+	defer r.source.mu.RUnlock()
+	return r.source.state.FindByIPAddress(IPAddress)
+}
+
+func (r *DirInstanceRepository) FindByMACAddress(MACAddress string) (*Instance, error) {
+	r.source.mu.RLock()
+	defer r.source.mu.RUnlock()
+	return r.source.state.FindByMACAddress(MACAddress)
+}
+
+func (r *DirInstanceRepository) Save(item *Instance) (*Instance, error) {
+	return nil, ErrReadOnly
+}
+
+// FindRevisions lists the current revision only, the history is in the
+// history of the directory
+func (r *DirInstanceRepository) FindRevisions(id string) ([]Revision, error) {
+	item, _ := r.FindOne(id)
+	if item == nil {
+		return []Revision{}, nil
+	}
+	return []Revision{{Revision: item.Revision, SavedAt: item.UpdatedAt}}, nil
+}
+
+func (r *DirInstanceRepository) FindRevision(id string, revision uint64) (*Instance, error) {
+	item, _ := r.FindOne(id)
+	if item == nil || item.Revision != revision {
+		return nil, ErrRevisionNotFound
+	}
+	return item, nil
+}
+
+// Modify changes the runtime state of an instance, ErrReadOnly is
+// returned if fn changes its configuration
+func (r *DirInstanceRepository) Modify(id string, fn func(item *Instance) error) (*Instance, error) {
+	r.source.mu.Lock()
+	defer r.source.mu.Unlock()
+	item := r.source.state.find(id)
+	if item == nil {
+		return nil, ErrInstanceNotFound
+	}
+	config := newBundleInstance(item)
+	if err := fn(item); err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(config, newBundleInstance(item)) {
+		return nil, ErrReadOnly
+	}
+	stored := *item
+	r.source.state.instances[id] = &stored
+	return item, nil
+}
+
+func (r *DirInstanceRepository) Delete(id string, revision uint64, deletedBy string) error {
+	return ErrReadOnly
+}
+
+// FindTrash is empty, instances deleted from the directory are gone
+func (r *DirInstanceRepository) FindTrash() ([]TrashedInstance, error) {
+	return []TrashedInstance{}, nil
+}
+
+func (r *DirInstanceRepository) FindTrashed(id string) (*TrashedInstance, error) {
+	return nil, ErrInstanceNotFound
+}
+
+func (r *DirInstanceRepository) Undelete(id string) (*Instance, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *DirInstanceRepository) Purge(id string) error {
+	return ErrReadOnly
+}
+
+func (r *DirInstanceRepository) PurgeTrash(before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (r *DirInstanceRepository) Batch(fn func(batch InstanceBatch) error) error {
+	return ErrReadOnly
+}
+
+// DirEnvironmentRepository serves the environment of a DirectorySource
+type DirEnvironmentRepository struct {
+	source *DirectorySource
+}
+
+func NewDirEnvironmentRepository(source *DirectorySource) *DirEnvironmentRepository {
+	return &DirEnvironmentRepository{source}
+}
+
+func (r *DirEnvironmentRepository) Get() (*Environment, error) {
+	r.source.mu.RLock()
+	defer r.source.mu.RUnlock()
+	item := r.source.state.environment
+	return &item, nil
+}
+
+func (r *DirEnvironmentRepository) Save(item *Environment) (*Environment, error) {
+	return nil, ErrReadOnly
+}
+
+func (r *DirEnvironmentRepository) FindRevisions() ([]Revision, error) {
+	item, _ := r.Get()
+	return []Revision{{Revision: item.Revision, SavedAt: item.UpdatedAt}}, nil
+}
+
+func (r *DirEnvironmentRepository) FindRevision(revision uint64) (*Environment, error) {
+	item, _ := r.Get()
+	if item.Revision != revision {
+		return nil, ErrRevisionNotFound
+	}
+	return item, nil
+}
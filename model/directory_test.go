@@ -0,0 +1,78 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectorySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloud-initer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	write("environment.yaml", "domain: example.com\n")
+	write("templates/web.yaml", "hostname: {{instance.name}}\n")
+	write("instances/web.yaml", `
+- name: web1
+  ipAddress: 10.0.0.1
+  macAddress: "00:00:00:00:00:01"
+  userDataTemplate: web.yaml
+- name: web2
+  ipAddress: 10.0.0.2
+  macAddress: "00:00:00:00:00:02"
+`)
+
+	source, err := NewDirectorySource(dir)
+	assert.Nil(t, err)
+	instances := NewDirInstanceRepository(source)
+	web1, err := instances.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "hostname: {{instance.name}}\n", web1.UserData)
+	assert.Equal(t, StatusPending, web1.Status)
+
+	// runtime changes are kept, configuration changes rejected
+	_, err = instances.Modify(web1.ID.Hex(), func(item *Instance) error {
+		item.UserDataFetches++
+		return nil
+	})
+	assert.Nil(t, err)
+	_, err = instances.Modify(web1.ID.Hex(), func(item *Instance) error {
+		item.Name = "web3"
+		return nil
+	})
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = instances.Save(web1)
+	assert.Equal(t, ErrReadOnly, err)
+
+	// the ID follows the name, the runtime state the ID
+	write("instances/web.yaml", `
+- name: web1
+  ipAddress: 10.0.0.9
+  macAddress: "00:00:00:00:00:01"
+`)
+	assert.Nil(t, source.Reload())
+	item, err := instances.FindOne(web1.ID.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.9", item.IPAddress)
+	assert.Equal(t, 1, item.UserDataFetches)
+	assert.Equal(t, web1.Revision+1, item.Revision)
+
+	// invalid changes keep the last good state
+	write("instances/dup.yaml", "name: dup\nipAddress: 10.0.0.9\nmacAddress: \"00:00:00:00:00:03\"\n")
+	assert.NotNil(t, source.Reload())
+	write("instances/dup.yaml", "name: dup\nipAddress: 10.0.0.3\nmacAddress: \"00:00:00:00:00:03\"\nuserDataTemplate: ../environment.yaml\n")
+	assert.NotNil(t, source.Reload())
+	items, err := instances.FindAll()
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.NotEmpty(t, source.Status().Error)
+	assert.Equal(t, 2, source.Status().Generation)
+}
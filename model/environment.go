@@ -1,6 +1,11 @@
 package model
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"time"
 
 	"gopkg.in/go-playground/validator.v9"
@@ -10,20 +15,29 @@ import (
 type Environment struct {
 	Config    string    `json:"config" validate:"yaml"`
 	UpdatedAt time.Time `json:"updatedAt"`
+	Revision  uint64    `json:"revision"`
 }
 
 type EnvironmentService interface {
 	GetEnvironment() (*Environment, error)
-	Update(newItem *Environment) (*Environment, error)
+	// Update fails with ErrRevisionConflict unless newItem.Revision is 0
+	// or the current revision
+	Update(newItem *Environment, actor *Actor) (*Environment, error)
+	FindRevisions() ([]Revision, error)
+	FindRevision(revision uint64) (*Environment, error)
+	// Restore saves the config of an earlier revision as a new revision
+	Restore(revision uint64, actor *Actor) (*Environment, error)
 }
 
 type EnvironmentServiceImpl struct {
 	Repository EnvironmentRepository
+	Audit      AuditService
 }
 
-func NewEnvironmentService(repository EnvironmentRepository, validator *validator.Validate) *EnvironmentServiceImpl {
+func NewEnvironmentService(repository EnvironmentRepository, audit AuditService, validator *validator.Validate) *EnvironmentServiceImpl {
 	service := &EnvironmentServiceImpl{
 		Repository: repository,
+		Audit:      audit,
 	}
 	validator.RegisterValidation("yaml", service.validateYAML)
 	return service
@@ -33,11 +47,46 @@ func (c *EnvironmentServiceImpl) GetEnvironment() (*Environment, error) {
 	return c.Repository.Get()
 }
 
-func (c *EnvironmentServiceImpl) Update(newItem *Environment) (*Environment, error) {
-	return c.Repository.Save(newItem)
+func (c *EnvironmentServiceImpl) Update(newItem *Environment, actor *Actor) (*Environment, error) {
+	return c.update(newItem, actor, AuditUpdate)
 }
 
-func (e *Environment) decodeConfig() (interface{}, error) {
+func (c *EnvironmentServiceImpl) Restore(revision uint64, actor *Actor) (*Environment, error) {
+	item, err := c.Repository.FindRevision(revision)
+	if err != nil {
+		return nil, err
+	}
+	return c.update(&Environment{Config: item.Config}, actor, AuditRestore)
+}
+
+func (c *EnvironmentServiceImpl) FindRevisions() ([]Revision, error) {
+	return c.Repository.FindRevisions()
+}
+
+func (c *EnvironmentServiceImpl) FindRevision(revision uint64) (*Environment, error) {
+	return c.Repository.FindRevision(revision)
+}
+
+func (c *EnvironmentServiceImpl) update(newItem *Environment, actor *Actor, action AuditAction) (*Environment, error) {
+	before, err := c.Repository.Get()
+	if err != nil {
+		return nil, err
+	}
+	if newItem.Revision == 0 {
+		// still fail if it's changed before saving
+		newItem.Revision = before.Revision
+	}
+	item, err := c.Repository.Save(newItem)
+	if err != nil {
+		return nil, err
+	}
+	// the config holds secrets, the audit log only tells which changed
+	redactedBefore, redactedAfter := redactedChange(before, item)
+	auditChange(c.Audit, actor, action, ResourceEnvironment, "", redactedBefore, redactedAfter)
+	return item, nil
+}
+
+func (e *Environment) decodeConfig() (map[interface{}]interface{}, error) {
 	item := make(map[interface{}]interface{})
 	if err := yaml.Unmarshal([]byte(e.Config), &item); err != nil {
 		return nil, err
@@ -45,6 +94,86 @@ func (e *Environment) decodeConfig() (interface{}, error) {
 	return item, nil
 }
 
+// redactedValue replaces configuration values hidden from principals
+// that may not reveal secrets
+const redactedValue = "******"
+
+// Redacted returns a copy of the environment with every value in the
+// config replaced, keeping the keys so the structure stays visible
+func (e *Environment) Redacted() (*Environment, error) {
+	return e.redact(func(interface{}) interface{} { return redactedValue })
+}
+
+func (e *Environment) redact(mask func(value interface{}) interface{}) (*Environment, error) {
+	config := yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(e.Config), &config); err != nil {
+		return nil, err
+	}
+	out, err := yaml.Marshal(redact(config, mask))
+	if err != nil {
+		return nil, err
+	}
+	item := *e
+	item.Config = string(out)
+	return &item, nil
+}
+
+func redact(value interface{}, mask func(value interface{}) interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			v[i].Value = redact(v[i].Value, mask)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i], mask)
+		}
+		return v
+	case nil:
+		return nil
+	default:
+		return mask(v)
+	}
+}
+
+// redactedChange redacts both versions of a change for the audit log.
+// Values are replaced by a hash keyed for this change only, so the diff
+// shows which values changed without giving them away, not even to a
+// dictionary.
+func redactedChange(before, after *Environment) (*Environment, *Environment) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return redactedFully(before), redactedFully(after)
+	}
+	mask := func(value interface{}) interface{} {
+		mac := hmac.New(sha256.New, key)
+		fmt.Fprint(mac, value)
+		return redactedValue + hex.EncodeToString(mac.Sum(nil))[:8]
+	}
+	return redactedWith(before, mask), redactedWith(after, mask)
+}
+
+func redactedWith(e *Environment, mask func(value interface{}) interface{}) *Environment {
+	if e.Config == "" {
+		return e
+	}
+	item, err := e.redact(mask)
+	if err != nil {
+		return redactedFully(e)
+	}
+	return item
+}
+
+// redactedFully hides the whole config
+func redactedFully(e *Environment) *Environment {
+	item := *e
+	if item.Config != "" {
+		item.Config = redactedValue
+	}
+	return &item
+}
+
 func (c *EnvironmentServiceImpl) validateYAML(fl validator.FieldLevel) bool {
 	item := fl.Parent().Interface().(*Environment)
 	_, err := item.decodeConfig()
@@ -11,9 +11,18 @@ import (
 var environmentBucket = []byte("environment")
 var environmentKey = []byte("base-env")
 
+// every saved version of the environment, keyed by revision
+var environmentRevisionBucket = []byte("environment-revisions")
+
 type EnvironmentRepository interface {
 	Get() (*Environment, error)
+	// Save stores the environment under a new revision. The stored
+	// environment has to be at item.Revision, else ErrRevisionConflict
+	// is returned.
 	Save(item *Environment) (*Environment, error)
+	FindRevisions() ([]Revision, error)
+	// FindRevision returns ErrRevisionNotFound for unknown revisions
+	FindRevision(revision uint64) (*Environment, error)
 }
 
 type BoltEnvironmentRepository struct {
@@ -22,7 +31,10 @@ type BoltEnvironmentRepository struct {
 
 func NewEnvironmentRepository(db *bolt.DB) *BoltEnvironmentRepository {
 	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(environmentBucket)
+		if _, err := tx.CreateBucketIfNotExists(environmentBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(environmentRevisionBucket)
 		return err
 	})
 	return &BoltEnvironmentRepository{db}
@@ -54,19 +66,53 @@ func (r *BoltEnvironmentRepository) Get() (*Environment, error) {
 func (r *BoltEnvironmentRepository) Save(item *Environment) (*Environment, error) {
 	err := r.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(environmentBucket)
-		{
-			item.UpdatedAt = time.Now()
-			enc, err := item.encodeEnvironment()
-			if err != nil {
-				return err
-			}
-			return b.Put(environmentKey, enc)
+		if err := checkRevision(b.Get(environmentKey), item.Revision); err != nil {
+			return err
 		}
+		item.UpdatedAt = time.Now()
+		enc, err := putRevision(tx.Bucket(environmentRevisionBucket), func(revision uint64) ([]byte, error) {
+			item.Revision = revision
+			return item.encodeEnvironment()
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(environmentKey, enc)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (r *BoltEnvironmentRepository) FindRevisions() ([]Revision, error) {
+	var items []Revision
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		items, err = listRevisions(tx.Bucket(environmentRevisionBucket))
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
+	return items, nil
+}
 
+func (r *BoltEnvironmentRepository) FindRevision(revision uint64) (*Environment, error) {
+	var item *Environment
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		itemData := getRevision(tx.Bucket(environmentRevisionBucket), revision)
+		if len(itemData) == 0 {
+			return ErrRevisionNotFound
+		}
+		item, err = decodeEnvironment(itemData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 	return item, nil
 }
 
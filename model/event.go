@@ -0,0 +1,97 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Event is a cloud-init reporting event, e.g. the start or finish of a
+// boot stage or module
+type Event struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	EventType   string    `json:"eventType"`
+	Origin      string    `json:"origin"`
+	Result      string    `json:"result,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	ReceivedAt  time.Time `json:"receivedAt"`
+}
+
+const (
+	eventFinish   = "finish"
+	resultSuccess = "SUCCESS"
+	resultFail    = "FAIL"
+)
+
+// status returns the instance status an event implies, if any. Only the
+// top-level stages (init-local, init-network, modules-config,
+// modules-final) are considered, not the individual modules.
+func (e *Event) status() (InstanceStatus, bool) {
+	if e.EventType != eventFinish {
+		return "", false
+	}
+	switch {
+	case e.Result == resultFail && isStage(e.Name):
+		return StatusFailed, true
+	case e.Result == resultSuccess && e.Name == "init-network":
+		return StatusBooted, true
+	case e.Result == resultSuccess && e.Name == "modules-final":
+		return StatusFinished, true
+	}
+	return "", false
+}
+
+func isStage(name string) bool {
+	return name != "" && !strings.ContainsRune(name, '/')
+}
+
+type EventService interface {
+	FindByInstance(id string) ([]Event, error)
+	RecordForClient(ipAddress, id string, event *Event) (*Instance, error)
+}
+
+type EventServiceImpl struct {
+	Repository      EventRepository
+	InstanceService InstanceService
+	// MaxPerInstance caps the events kept for each instance
+	MaxPerInstance int
+}
+
+func NewEventService(repository EventRepository, instanceService InstanceService, maxPerInstance int) *EventServiceImpl {
+	service := &EventServiceImpl{
+		Repository:      repository,
+		InstanceService: instanceService,
+		MaxPerInstance:  maxPerInstance,
+	}
+	return service
+}
+
+func (c *EventServiceImpl) FindByInstance(id string) ([]Event, error) {
+	return c.Repository.FindByInstance(id)
+}
+
+// RecordForClient stores an event reported by the instance with the
+// given IP address and updates its status when the event completes or
+// fails a boot stage
+func (c *EventServiceImpl) RecordForClient(ipAddress, id string, event *Event) (*Instance, error) {
+	item, err := c.InstanceService.FindForClient(ipAddress, id)
+	if err != nil {
+		return nil, err
+	}
+	event.ReceivedAt = time.Now()
+	if err := c.Repository.Append(item.ID.Hex(), event, c.MaxPerInstance); err != nil {
+		return nil, err
+	}
+	if status, ok := event.status(); ok && item.CurrentStatus() != status {
+		updated, err := c.InstanceService.Transition(item.ID.Hex(), status, nil)
+		if err != nil && errors.Cause(err) != ErrIllegalTransition {
+			return nil, err
+		}
+		if err == nil {
+			item = updated
+		}
+	}
+	return item, nil
+}
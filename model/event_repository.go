@@ -0,0 +1,103 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// events are kept in a nested bucket per instance, keyed by sequence
+var eventBucket = []byte("instance-events")
+
+type EventRepository interface {
+	FindByInstance(id string) ([]Event, error)
+	// Append stores the event and drops the oldest events of the
+	// instance beyond max
+	Append(id string, event *Event, max int) error
+}
+
+type BoltEventRepository struct {
+	db *bolt.DB
+}
+
+func NewEventRepository(db *bolt.DB) *BoltEventRepository {
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventBucket)
+		return err
+	})
+	return &BoltEventRepository{db}
+}
+
+func (r *BoltEventRepository) FindByInstance(id string) ([]Event, error) {
+	items := []Event{}
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventBucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var item Event
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *BoltEventRepository) Append(id string, event *Event, max int) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(eventBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		enc, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(sequenceKey(seq), enc); err != nil {
+			return err
+		}
+		if max <= 0 || seq <= uint64(max) {
+			return nil
+		}
+		// keys sort by sequence, so everything before the first key to
+		// keep is old
+		keep := sequenceKey(seq - uint64(max) + 1)
+		return deleteBefore(b, keep)
+	})
+}
+
+func sequenceKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// deleteBefore removes all keys of the bucket sorting before key. Keys
+// are collected first as deleting through a cursor skips items.
+func deleteBefore(b *bolt.Bucket, key []byte) error {
+	var old [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, key) < 0; k, _ = c.Next() {
+		old = append(old, k)
+	}
+	for _, k := range old {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
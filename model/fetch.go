@@ -0,0 +1,129 @@
+package model
+
+import (
+	"net"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ResolvedBy is how the instance requesting a document was identified
+type ResolvedBy string
+
+const (
+	ResolvedByIP   ResolvedBy = "ip"
+	ResolvedByMAC  ResolvedBy = "mac"
+	ResolvedByPath ResolvedBy = "path"
+)
+
+// Client is a guest requesting a document
+type Client struct {
+	IPAddress string
+	UserAgent string
+	// Key is the MAC address, instance ID or name from the request
+	// path. Without it the instance is found by IPAddress.
+	Key string
+}
+
+// ResolvedBy returns how the instance of the client is looked up
+func (c *Client) ResolvedBy() ResolvedBy {
+	if c.Key == "" {
+		return ResolvedByIP
+	}
+	if _, err := net.ParseMAC(c.Key); err == nil {
+		return ResolvedByMAC
+	}
+	return ResolvedByPath
+}
+
+// Fetch is an entry of the access log of an instance's documents
+type Fetch struct {
+	Timestamp  time.Time  `json:"timestamp"`
+	SourceIP   string     `json:"sourceIp"`
+	UserAgent  string     `json:"userAgent"`
+	ResolvedBy ResolvedBy `json:"resolvedBy"`
+	Document   Document   `json:"document"`
+	Status     int        `json:"status"`
+	// ContentHash is the hex SHA-256 of the document served
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+type FetchService interface {
+	FindByInstance(id string) ([]Fetch, error)
+	Record(id string, fetch *Fetch) error
+	// Prune drops the fetches of all instances older than the retention
+	Prune() error
+}
+
+type FetchServiceImpl struct {
+	Repository FetchRepository
+	// Retention is how long fetches are kept
+	Retention time.Duration
+}
+
+func NewFetchService(repository FetchRepository, retention time.Duration) *FetchServiceImpl {
+	service := &FetchServiceImpl{
+		Repository: repository,
+		Retention:  retention,
+	}
+	return service
+}
+
+func (c *FetchServiceImpl) FindByInstance(id string) ([]Fetch, error) {
+	return c.Repository.FindByInstance(id)
+}
+
+func (c *FetchServiceImpl) Record(id string, fetch *Fetch) error {
+	if fetch.Timestamp.IsZero() {
+		fetch.Timestamp = time.Now()
+	}
+	return c.Repository.Append(id, fetch, c.cutoff())
+}
+
+func (c *FetchServiceImpl) Prune() error {
+	return c.Repository.DeleteBefore(c.cutoff())
+}
+
+func (c *FetchServiceImpl) cutoff() time.Time {
+	return time.Now().Add(-c.Retention)
+}
+
+// resolveClient finds the instance a document request is for
+func (c *InstanceServiceImpl) resolveClient(client *Client) (*Instance, error) {
+	var item *Instance
+	var err error
+	switch client.ResolvedBy() {
+	case ResolvedByIP:
+		item, err = c.Repository.FindByIPAddress(client.IPAddress)
+	case ResolvedByMAC:
+		item, err = c.Repository.FindByMACAddress(client.Key)
+	case ResolvedByPath:
+		item, err = c.findByIDOrName(client.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrInstanceNotFound
+	}
+	return item, nil
+}
+
+func (c *InstanceServiceImpl) findByIDOrName(key string) (*Instance, error) {
+	if bson.IsObjectIdHex(key) {
+		item, err := c.Repository.FindOne(key)
+		if err != nil || item != nil {
+			return item, err
+		}
+	}
+	items, err := c.Repository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Name == key {
+			return &item, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// fetches are kept in a nested bucket per instance, keyed by time
+var fetchBucket = []byte("instance-fetches")
+
+type FetchRepository interface {
+	FindByInstance(id string) ([]Fetch, error)
+	// Append stores the fetch and drops the fetches of the instance
+	// made before the given time
+	Append(id string, fetch *Fetch, before time.Time) error
+	// DeleteBefore drops the fetches of all instances made before the
+	// given time
+	DeleteBefore(before time.Time) error
+}
+
+type BoltFetchRepository struct {
+	db *bolt.DB
+}
+
+func NewFetchRepository(db *bolt.DB) *BoltFetchRepository {
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(fetchBucket)
+		return err
+	})
+	return &BoltFetchRepository{db}
+}
+
+func (r *BoltFetchRepository) FindByInstance(id string) ([]Fetch, error) {
+	items := []Fetch{}
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(fetchBucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var item Fetch
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *BoltFetchRepository) Append(id string, fetch *Fetch, before time.Time) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(fetchBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		enc, err := json.Marshal(fetch)
+		if err != nil {
+			return err
+		}
+		// the sequence keeps fetches made at the same time apart
+		k := append(timeKey(fetch.Timestamp), sequenceKey(seq)...)
+		if err := b.Put(k, enc); err != nil {
+			return err
+		}
+		return deleteBefore(b, timeKey(before))
+	})
+}
+
+func (r *BoltFetchRepository) DeleteBefore(before time.Time) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		parent := tx.Bucket(fetchBucket)
+		var empty [][]byte
+		err := parent.ForEach(func(id, v []byte) error {
+			b := parent.Bucket(id)
+			if b == nil {
+				return nil
+			}
+			if err := deleteBefore(b, timeKey(before)); err != nil {
+				return err
+			}
+			if k, _ := b.Cursor().First(); k == nil {
+				empty = append(empty, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range empty {
+			if err := parent.DeleteBucket(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
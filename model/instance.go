@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"time"
 
 	"github.com/pkg/errors"
@@ -9,38 +10,88 @@ import (
 )
 
 type Instance struct {
-	ID          bson.ObjectId `json:"id"`
-	Name        string        `json:"name" validate:"required"`
-	IPAddress   string        `json:"ipAddress" validate:"required,ip,uniqueIP"`
-	MACAddress  string        `json:"macAddress" validate:"required,mac,uniqueMAC"`
-	UserData    string        `json:"userData"`
-	MetaData    string        `json:"metaData"`
-	CreatedAt   time.Time     `json:"createdAt"`
-	UpdatedAt   time.Time     `json:"updatedAt"`
-	RequestedAt time.Time     `json:"requestedAt"`
-	RequestedBy string        `json:"requestedBy"`
+	ID          bson.ObjectId     `json:"id"`
+	Name        string            `json:"name" validate:"required"`
+	IPAddress   string            `json:"ipAddress" validate:"required,ip,uniqueIP"`
+	MACAddress  string            `json:"macAddress" validate:"required,mac,uniqueMAC"`
+	Labels      map[string]string `json:"labels"`
+	UserData    string            `json:"userData"`
+	MetaData    string            `json:"metaData"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	Revision    uint64            `json:"revision"`
+	RequestedAt time.Time         `json:"requestedAt"`
+	RequestedBy string            `json:"requestedBy"`
+
+	Status        InstanceStatus     `json:"status"`
+	StatusHistory []StatusTransition `json:"statusHistory"`
+
+	// reported by the guest through phone_home
+	SSHHostKeys      map[string]string `json:"sshHostKeys"`
+	ReportedHostname string            `json:"reportedHostname"`
+	ReportedFQDN     string            `json:"reportedFqdn"`
+	// ReportedInstanceID is the instance-id of the meta-data as the
+	// guest reported it
+	ReportedInstanceID string    `json:"reportedInstanceId"`
+	PhoneHomeAt        time.Time `json:"phoneHomeAt"`
+
+	Delivery        DeliveryPolicy `json:"delivery"`
+	ArmedAt         time.Time      `json:"armedAt"`
+	UserDataFetches int            `json:"userDataFetches"`
 }
 
+var ErrInstanceNotFound = errors.New("instance not found")
+
 type InstanceService interface {
 	FindAll() ([]Instance, error)
 	FindOne(id string) (*Instance, error)
-	FindByIPForUserAgent(ipAddress, userAgent string) (*Instance, error)
-	Create(item *Instance) (*Instance, error)
-	Update(id string, newItem *Instance) (*Instance, error)
-	Delete(id string) error
+	FindPage(query *InstanceQuery) ([]Instance, int, error)
+	FetchForClient(client *Client, document Document) (*Instance, bool, error)
+	// Create, Update, Arm, Transition and Delete audit the changes made
+	// by the actor. Changes reported by guests come without an actor.
+	Create(item *Instance, actor *Actor) (*Instance, error)
+	// Update fails with ErrRevisionConflict unless newItem.Revision is 0
+	// or the current revision
+	Update(id string, newItem *Instance, actor *Actor) (*Instance, error)
+	Arm(id string, actor *Actor) (*Instance, error)
+	Transition(id string, status InstanceStatus, actor *Actor) (*Instance, error)
+	ReportStatusForClient(ipAddress string, status InstanceStatus) (*Instance, error)
+	FindForClient(ipAddress, id string) (*Instance, error)
+	PhoneHome(ipAddress, id string, report *PhoneHomeReport) (*Instance, error)
+	// Delete moves the instance to the trash. It fails with
+	// ErrRevisionConflict unless revision is 0 or the current revision.
+	Delete(id string, revision uint64, actor *Actor) error
+	FindTrash() ([]TrashedInstance, error)
+	FindTrashed(id string) (*TrashedInstance, error)
+	Undelete(id string, actor *Actor) (*Instance, error)
+	Purge(id string, actor *Actor) error
+	PurgeTrash(before time.Time) (int, error)
+	FindRevisions(id string) ([]Revision, error)
+	FindRevision(id string, revision uint64) (*Instance, error)
+	// Restore saves the configuration of an earlier revision as a new
+	// revision
+	Restore(id string, revision uint64, actor *Actor) (*Instance, error)
+	// Batch applies the operations in a single transaction. Operations
+	// on instances outside the principal's scope fail.
+	Batch(ops []BatchOperation, options BatchOptions, principal *Principal, actor *Actor) ([]BatchResult, error)
 }
 
 type InstanceServiceImpl struct {
 	Repository         InstanceRepository
 	EnvironmentService EnvironmentService
+	Audit              AuditService
+	validator          *validator.Validate
 }
 
-func NewInstanceService(repository InstanceRepository, validator *validator.Validate) *InstanceServiceImpl {
+func NewInstanceService(repository InstanceRepository, audit AuditService, validator *validator.Validate) *InstanceServiceImpl {
 	service := &InstanceServiceImpl{
 		Repository: repository,
+		Audit:      audit,
+		validator:  validator,
 	}
-	validator.RegisterValidation("uniqueIP", service.validateUniqueIP)
-	validator.RegisterValidation("uniqueMAC", service.validateUniqueMAC)
+	validator.RegisterValidationCtx("uniqueIP", service.validateUniqueIP)
+	validator.RegisterValidationCtx("uniqueMAC", service.validateUniqueMAC)
+	validator.RegisterValidation("deliveryPolicy", validateDeliveryPolicy)
 	return service
 }
 
@@ -52,43 +103,252 @@ func (c *InstanceServiceImpl) FindOne(id string) (*Instance, error) {
 	return c.Repository.FindOne(id)
 }
 
-func (c *InstanceServiceImpl) FindByIPForUserAgent(ipAddress, userAgent string) (*Instance, error) {
-	item, err := c.Repository.FindByIPAddress(ipAddress)
-	item.RequestedAt = time.Now()
-	item.RequestedBy = userAgent
-	c.Repository.Save(item)
-	return item, err
+func (c *InstanceServiceImpl) FindPage(query *InstanceQuery) ([]Instance, int, error) {
+	return c.Repository.FindPage(query)
+}
+
+// FetchForClient finds the instance requesting a document and records
+// the request. For user-data it applies the delivery policy and reports
+// whether the document may be served.
+func (c *InstanceServiceImpl) FetchForClient(client *Client, document Document) (*Instance, bool, error) {
+	item, err := c.resolveClient(client)
+	if err != nil {
+		return nil, false, err
+	}
+	allowed := true
+	item, err = c.Repository.Modify(item.ID.Hex(), func(item *Instance) error {
+		now := time.Now()
+		item.RequestedAt = now
+		item.RequestedBy = client.UserAgent
+		switch document {
+		case DocumentMetaData:
+			item.advance(StatusMetaDataFetched, now)
+		case DocumentUserData:
+			allowed = item.Delivery.Allows(item, now)
+			if allowed {
+				item.UserDataFetches++
+				item.advance(StatusUserDataFetched, now)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return item, allowed, nil
+}
+
+func (c *InstanceServiceImpl) Create(item *Instance, actor *Actor) (*Instance, error) {
+	item.reset()
+	item, err := c.Repository.Save(item)
+	if err != nil {
+		return nil, err
+	}
+	c.audit(actor, AuditCreate, nil, item)
+	return item, nil
 }
 
-func (c *InstanceServiceImpl) Create(item *Instance) (*Instance, error) {
-	item.ID = ""
-	return c.Repository.Save(item)
+func (c *InstanceServiceImpl) Update(id string, newItem *Instance, actor *Actor) (*Instance, error) {
+	return c.update(id, newItem, actor, AuditUpdate)
 }
 
-func (c *InstanceServiceImpl) Update(id string, newItem *Instance) (*Instance, error) {
+func (c *InstanceServiceImpl) Restore(id string, revision uint64, actor *Actor) (*Instance, error) {
+	item, err := c.Repository.FindRevision(id, revision)
+	if err != nil {
+		return nil, err
+	}
+	// restoring applies to whatever the current revision is
+	item.Revision = 0
+	return c.update(id, item, actor, AuditRestore)
+}
+
+func (c *InstanceServiceImpl) FindRevisions(id string) ([]Revision, error) {
+	return c.Repository.FindRevisions(id)
+}
+
+func (c *InstanceServiceImpl) FindRevision(id string, revision uint64) (*Instance, error) {
+	return c.Repository.FindRevision(id, revision)
+}
+
+// update copies the configuration of newItem to the instance, keeping
+// its runtime state
+func (c *InstanceServiceImpl) update(id string, newItem *Instance, actor *Actor, action AuditAction) (*Instance, error) {
 	item, err := c.Repository.FindOne(id)
 	if err != nil {
 		return nil, err
 	}
 	if item == nil {
-		return nil, errors.New("instance not found")
+		return nil, ErrInstanceNotFound
+	}
+	if newItem.Revision != 0 && newItem.Revision != item.Revision {
+		return nil, ErrRevisionConflict
+	}
+	before := *item
+	item.configure(newItem)
+	item, err = c.Repository.Save(item)
+	if err != nil {
+		return nil, err
+	}
+	c.audit(actor, action, &before, item)
+	return item, nil
+}
+
+// reset clears the runtime state of a new instance
+func (p *Instance) reset() {
+	p.ID = ""
+	p.Revision = 0
+	p.RequestedAt = time.Time{}
+	p.RequestedBy = ""
+	p.ArmedAt = time.Time{}
+	p.UserDataFetches = 0
+	p.Status = ""
+	p.StatusHistory = nil
+	p.SSHHostKeys = nil
+	p.ReportedHostname = ""
+	p.ReportedFQDN = ""
+	p.ReportedInstanceID = ""
+	p.PhoneHomeAt = time.Time{}
+	p.setStatus(StatusPending, time.Now())
+}
+
+// configure copies the configuration of newItem
+func (p *Instance) configure(newItem *Instance) {
+	p.Name = newItem.Name
+	p.IPAddress = newItem.IPAddress
+	p.MACAddress = newItem.MACAddress
+	p.Labels = newItem.Labels
+	p.UserData = newItem.UserData
+	p.MetaData = newItem.MetaData
+	p.Delivery = newItem.Delivery
+	p.UpdatedAt = time.Now()
+}
+
+// Arm opens the provisioning window and resets the fetch counter, so
+// the user-data can be served again according to the delivery policy
+func (c *InstanceServiceImpl) Arm(id string, actor *Actor) (*Instance, error) {
+	var before Instance
+	item, err := c.Repository.Modify(id, func(item *Instance) error {
+		before = *item
+		item.ArmedAt = time.Now()
+		item.UserDataFetches = 0
+		return item.Transition(StatusArmed, item.ArmedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.audit(actor, AuditArm, &before, item)
+	return item, nil
+}
+
+// Transition moves the instance to a new status if the state machine
+// allows it
+func (c *InstanceServiceImpl) Transition(id string, status InstanceStatus, actor *Actor) (*Instance, error) {
+	if !status.Valid() {
+		return nil, errors.Errorf("unknown status '%s'", status)
+	}
+	var before Instance
+	item, err := c.Repository.Modify(id, func(item *Instance) error {
+		before = *item
+		return item.Transition(status, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.audit(actor, AuditTransition, &before, item)
+	return item, nil
+}
+
+// FindForClient finds the instance a guest callback comes from by the
+// caller's IP address. An ID or name the guest identifies itself with
+// has to match, so guests can't report on behalf of others.
+func (c *InstanceServiceImpl) FindForClient(ipAddress, id string) (*Instance, error) {
+	item, err := c.Repository.FindByIPAddress(ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrInstanceNotFound
 	}
-	item.Name = newItem.Name
-	item.IPAddress = newItem.IPAddress
-	item.MACAddress = newItem.MACAddress
-	item.UserData = newItem.UserData
-	item.MetaData = newItem.MetaData
-	item.UpdatedAt = time.Now()
-	return c.Repository.Save(item)
+	if !item.identifiedBy(id) {
+		return nil, ErrInstanceMismatch
+	}
+	return item, nil
+}
+
+// identifiedBy reports whether the ID or name matches the instance. An
+// empty id matches any instance.
+func (p *Instance) identifiedBy(id string) bool {
+	return id == "" || id == p.ID.Hex() || id == p.Name
 }
 
-func (c *InstanceServiceImpl) Delete(id string) error {
-	return c.Repository.Delete(id)
+// ReportStatusForClient applies a status reported by the guest itself
+func (c *InstanceServiceImpl) ReportStatusForClient(ipAddress string, status InstanceStatus) (*Instance, error) {
+	switch status {
+	case StatusBooted, StatusFinished, StatusFailed:
+	default:
+		return nil, errors.Wrapf(ErrIllegalTransition, "guests can't report status '%s'", status)
+	}
+	item, err := c.FindForClient(ipAddress, "")
+	if err != nil {
+		return nil, err
+	}
+	return c.Transition(item.ID.Hex(), status, nil)
+}
+
+func (c *InstanceServiceImpl) Delete(id string, revision uint64, actor *Actor) error {
+	item, err := c.Repository.FindOne(id)
+	if err != nil {
+		return err
+	}
+	deletedBy := ""
+	if actor != nil {
+		deletedBy = actor.Name
+	}
+	if err := c.Repository.Delete(id, revision, deletedBy); err != nil {
+		return err
+	}
+	if item == nil {
+		return nil
+	}
+	c.audit(actor, AuditDelete, item, nil)
+	return nil
+}
+
+// audit records a change unless it was made without an actor
+func (c *InstanceServiceImpl) audit(actor *Actor, action AuditAction, before, after *Instance) {
+	// keep nil pointers from turning into non-nil interfaces
+	var a, b interface{}
+	id := ""
+	if before != nil {
+		a, id = before, before.ID.Hex()
+	}
+	if after != nil {
+		b, id = after, after.ID.Hex()
+	}
+	auditChange(c.Audit, actor, action, ResourceInstance, id, a, b)
+}
+
+// instanceLookup finds instances for the uniqueness checks, in the
+// repository or within a batch
+type instanceLookup interface {
+	FindByIPAddress(IPAddress string) (*Instance, error)
+	FindByMACAddress(MACAddress string) (*Instance, error)
+}
+
+type lookupKey struct{}
+
+// lookup returns the lookup the validation context carries, the
+// repository by default
+func (c *InstanceServiceImpl) lookup(ctx context.Context) instanceLookup {
+	if l, ok := ctx.Value(lookupKey{}).(instanceLookup); ok {
+		return l
+	}
+	return c.Repository
 }
 
-func (c *InstanceServiceImpl) validateUniqueIP(fl validator.FieldLevel) bool {
+func (c *InstanceServiceImpl) validateUniqueIP(ctx context.Context, fl validator.FieldLevel) bool {
 	item := fl.Parent().Interface().(*Instance)
-	existingItem, err := c.Repository.FindByIPAddress(item.IPAddress)
+	existingItem, err := c.lookup(ctx).FindByIPAddress(item.IPAddress)
 	if err != nil {
 		return false
 	}
@@ -98,9 +358,9 @@ func (c *InstanceServiceImpl) validateUniqueIP(fl validator.FieldLevel) bool {
 	return true
 }
 
-func (c *InstanceServiceImpl) validateUniqueMAC(fl validator.FieldLevel) bool {
+func (c *InstanceServiceImpl) validateUniqueMAC(ctx context.Context, fl validator.FieldLevel) bool {
 	item := fl.Parent().Interface().(*Instance)
-	existingItem, err := c.Repository.FindByMACAddress(item.MACAddress)
+	existingItem, err := c.lookup(ctx).FindByMACAddress(item.MACAddress)
 	if err != nil {
 		return false
 	}
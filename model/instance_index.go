@@ -0,0 +1,159 @@
+package model
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/boltdb/bolt"
+)
+
+// instanceIndexBucket holds a nested bucket per index. Index keys start
+// with the indexed value and end with the instance ID to keep them
+// unique, the value is the instance ID.
+var instanceIndexBucket = []byte("instance-index")
+
+var (
+	nameIndex        = []byte("name")
+	ipAddressIndex   = []byte("ipAddress")
+	macAddressIndex  = []byte("macAddress")
+	requestedAtIndex = []byte("requestedAt")
+	createdAtIndex   = []byte("createdAt")
+)
+
+var instanceIndexes = [][]byte{nameIndex, ipAddressIndex, macAddressIndex, requestedAtIndex, createdAtIndex}
+
+// keySeparator ends variable length values, it sorts before any other byte
+const keySeparator = 0
+
+// indexKey returns the key of the instance in the index, nil when the
+// instance isn't indexed in it
+func (p *Instance) indexKey(index []byte) []byte {
+	var value []byte
+	switch {
+	case bytes.Equal(index, nameIndex):
+		value = append([]byte(p.Name), keySeparator)
+	case bytes.Equal(index, ipAddressIndex):
+		value = ipKey(p.IPAddress)
+	case bytes.Equal(index, macAddressIndex):
+		value = macKey(p.MACAddress)
+	case bytes.Equal(index, requestedAtIndex):
+		value = make([]byte, 8)
+		if !p.RequestedAt.IsZero() {
+			value = timeKey(p.RequestedAt)
+		}
+	case bytes.Equal(index, createdAtIndex):
+		value = make([]byte, 8)
+		if !p.CreatedAt.IsZero() {
+			value = timeKey(p.CreatedAt)
+		}
+	}
+	if value == nil {
+		return nil
+	}
+	return append(value, p.ID.Hex()...)
+}
+
+// ipKey sorts IPv4 and IPv6 addresses numerically
+func ipKey(ipAddress string) []byte {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return nil
+	}
+	return []byte(ip.To16())
+}
+
+// macKey makes the different notations of a MAC address equal
+func macKey(macAddress string) []byte {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return nil
+	}
+	return append([]byte(mac.String()), keySeparator)
+}
+
+// updateIndexes moves the index entries of an instance from the old to
+// the new version, either of which is nil on create or delete
+func updateIndexes(tx *bolt.Tx, old, new *Instance) error {
+	indexes := tx.Bucket(instanceIndexBucket)
+	for _, index := range instanceIndexes {
+		var oldKey, newKey []byte
+		if old != nil {
+			oldKey = old.indexKey(index)
+		}
+		if new != nil {
+			newKey = new.indexKey(index)
+		}
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		b := indexes.Bucket(index)
+		if oldKey != nil {
+			if err := b.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			if err := b.Put(newKey, []byte(new.ID.Hex())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createIndexes creates the index buckets and indexes the stored
+// instances when they don't exist yet
+func createIndexes(tx *bolt.Tx) error {
+	if tx.Bucket(instanceIndexBucket) != nil {
+		return nil
+	}
+	indexes, err := tx.CreateBucket(instanceIndexBucket)
+	if err != nil {
+		return err
+	}
+	for _, index := range instanceIndexes {
+		if _, err := indexes.CreateBucket(index); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(instanceBucket).ForEach(func(k, v []byte) error {
+		item, err := decode(v)
+		if err != nil {
+			return err
+		}
+		return updateIndexes(tx, nil, item)
+	})
+}
+
+// createCreatedAtIndex indexes the stored instances by creation time,
+// which their IDs don't tell when they were supplied on import
+func createCreatedAtIndex(tx *bolt.Tx) error {
+	b, err := tx.Bucket(instanceIndexBucket).CreateBucketIfNotExists(createdAtIndex)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(instanceBucket).ForEach(func(k, v []byte) error {
+		item, err := decode(v)
+		if err != nil {
+			return err
+		}
+		return b.Put(item.indexKey(createdAtIndex), k)
+	})
+}
+
+// findByIndex returns the first instance whose key in the index starts
+// with prefix
+func findByIndex(tx *bolt.Tx, index, prefix []byte) (*Instance, error) {
+	if prefix == nil {
+		return nil, nil
+	}
+	k, id := tx.Bucket(instanceIndexBucket).Bucket(index).Cursor().Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+	itemData := tx.Bucket(instanceBucket).Get(id)
+	if len(itemData) == 0 {
+		return nil, nil
+	}
+	return decode(itemData)
+}
@@ -0,0 +1,287 @@
+package model
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// InstanceSort is the order instances are listed in
+type InstanceSort string
+
+const (
+	SortByName        InstanceSort = "name"
+	SortByIPAddress   InstanceSort = "ipAddress"
+	SortByCreatedAt   InstanceSort = "createdAt"
+	SortByRequestedAt InstanceSort = "requestedAt"
+)
+
+// InstanceQuery selects a page of instances. Empty fields don't filter.
+type InstanceQuery struct {
+	// Page starts at 1. A PageSize of 0 returns all instances.
+	Page     int
+	PageSize int
+
+	Sort       InstanceSort
+	Descending bool
+
+	NamePrefix string
+	Network    *net.IPNet
+	MACAddress string
+	Selector   Selector
+	Status     InstanceStatus
+	// NeverRequested selects instances that never fetched a document
+	NeverRequested bool
+	// Scope holds the labels the principal is restricted to
+	Scope map[string]string
+}
+
+// ParseInstanceSort parses a sort field, descending with a leading "-"
+func ParseInstanceSort(s string) (InstanceSort, bool, error) {
+	descending := strings.HasPrefix(s, "-")
+	sort := InstanceSort(strings.TrimPrefix(s, "-"))
+	switch sort {
+	case "":
+		return SortByCreatedAt, descending, nil
+	case SortByName, SortByIPAddress, SortByCreatedAt, SortByRequestedAt:
+		return sort, descending, nil
+	}
+	return "", false, errors.Errorf("can't sort by '%s'", sort)
+}
+
+// Matches reports whether the instance passes all filters
+func (q *InstanceQuery) Matches(item *Instance) bool {
+	if q.NamePrefix != "" && !strings.HasPrefix(item.Name, q.NamePrefix) {
+		return false
+	}
+	if q.Network != nil {
+		ip := net.ParseIP(item.IPAddress)
+		if ip == nil || !q.Network.Contains(ip) {
+			return false
+		}
+	}
+	if q.MACAddress != "" && !bytes.Equal(macKey(item.MACAddress), macKey(q.MACAddress)) {
+		return false
+	}
+	if !q.Selector.Matches(item.Labels) {
+		return false
+	}
+	for k, v := range q.Scope {
+		if item.Labels[k] != v {
+			return false
+		}
+	}
+	if q.Status != "" && item.CurrentStatus() != q.Status {
+		return false
+	}
+	if q.NeverRequested && !item.RequestedAt.IsZero() {
+		return false
+	}
+	return true
+}
+
+// FindPage walks the index of the sort order, limited to the range the
+// name prefix or network allows, and decodes the instances one by one.
+// It returns the instances on the page and the total number matching.
+func (r *BoltInstanceRepository) FindPage(q *InstanceQuery) ([]Instance, int, error) {
+	items := []Instance{}
+	total := 0
+	page := q.Page
+	if page < 1 {
+		page = 1
+	}
+	skip := (page - 1) * q.PageSize
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		instances := tx.Bucket(instanceBucket)
+		return walkInstances(tx, q, func(id []byte) error {
+			itemData := instances.Get(id)
+			if len(itemData) == 0 {
+				return nil
+			}
+			item, err := decode(itemData)
+			if err != nil {
+				return err
+			}
+			if !q.Matches(item) {
+				return nil
+			}
+			if total >= skip && (q.PageSize == 0 || len(items) < q.PageSize) {
+				items = append(items, *item)
+			}
+			total++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return items, total, nil
+}
+
+// findPage selects a page of the instances held in memory
+func findPage(all []Instance, q *InstanceQuery) ([]Instance, int) {
+	items := []Instance{}
+	for i := range all {
+		if q.Matches(&all[i]) {
+			items = append(items, all[i])
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if q.Descending {
+			i, j = j, i
+		}
+		return instanceLess(&items[i], &items[j], q.Sort)
+	})
+	total := len(items)
+	if q.PageSize == 0 {
+		return items, total
+	}
+	page := q.Page
+	if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * q.PageSize
+	if start > total {
+		start = total
+	}
+	end := start + q.PageSize
+	if end > total {
+		end = total
+	}
+	return items[start:end], total
+}
+
+// instanceLess orders instances like the indexes do, ties by ID
+func instanceLess(a, b *Instance, by InstanceSort) bool {
+	var c int
+	switch by {
+	case SortByName:
+		c = strings.Compare(a.Name, b.Name)
+	case SortByIPAddress:
+		c = bytes.Compare(ipKey(a.IPAddress), ipKey(b.IPAddress))
+	case SortByRequestedAt:
+		c = compareTime(a.RequestedAt, b.RequestedAt)
+	default:
+		c = compareTime(a.CreatedAt, b.CreatedAt)
+	}
+	if c != 0 {
+		return c < 0
+	}
+	return a.ID < b.ID
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// walkInstances calls fn with the IDs of the instances that may match
+// the query, in the requested order
+func walkInstances(tx *bolt.Tx, q *InstanceQuery, fn func(id []byte) error) error {
+	indexes := tx.Bucket(instanceIndexBucket)
+	// index values are instance IDs
+	byValue := func(k, v []byte) error {
+		return fn(v)
+	}
+	if q.MACAddress != "" {
+		// MAC addresses are unique, no need to sort
+		prefix := macKey(q.MACAddress)
+		if prefix == nil {
+			return nil
+		}
+		return walkRange(indexes.Bucket(macAddressIndex).Cursor(), prefix, prefixEnd(prefix), false, byValue)
+	}
+
+	switch q.Sort {
+	case SortByName:
+		var lower, upper []byte
+		if q.NamePrefix != "" {
+			lower = []byte(q.NamePrefix)
+			upper = prefixEnd(lower)
+		}
+		return walkRange(indexes.Bucket(nameIndex).Cursor(), lower, upper, q.Descending, byValue)
+	case SortByIPAddress:
+		var lower, upper []byte
+		if q.Network != nil {
+			lower, upper = networkRange(q.Network)
+		}
+		return walkRange(indexes.Bucket(ipAddressIndex).Cursor(), lower, upper, q.Descending, byValue)
+	case SortByRequestedAt:
+		return walkRange(indexes.Bucket(requestedAtIndex).Cursor(), nil, nil, q.Descending, byValue)
+	}
+	return walkRange(indexes.Bucket(createdAtIndex).Cursor(), nil, nil, q.Descending, byValue)
+}
+
+// walkRange calls fn with the keys from lower up to but excluding upper,
+// nil bounds are open
+func walkRange(c *bolt.Cursor, lower, upper []byte, descending bool, fn func(k, v []byte) error) error {
+	var k, v []byte
+	switch {
+	case !descending && lower != nil:
+		k, v = c.Seek(lower)
+	case !descending:
+		k, v = c.First()
+	case upper != nil:
+		// the last key before upper
+		if k, _ = c.Seek(upper); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	default:
+		k, v = c.Last()
+	}
+	for ; k != nil; k, v = next(c, descending) {
+		if upper != nil && bytes.Compare(k, upper) >= 0 {
+			return nil
+		}
+		if lower != nil && bytes.Compare(k, lower) < 0 {
+			return nil
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func next(c *bolt.Cursor, descending bool) ([]byte, []byte) {
+	if descending {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+// prefixEnd returns the first key after all keys starting with prefix,
+// nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// networkRange returns the index range of the addresses in the network
+func networkRange(network *net.IPNet) ([]byte, []byte) {
+	first := network.IP.Mask(network.Mask)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^network.Mask[i]
+	}
+	return []byte(first.To16()), prefixEnd([]byte(last.To16()))
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func names(items []Instance) []string {
+	result := []string{}
+	for _, item := range items {
+		result = append(result, item.Name)
+	}
+	return result
+}
+
+func TestFindPage(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	repo := NewInstanceRepository(db)
+
+	for _, item := range []Instance{
+		{Name: "web2", IPAddress: "10.0.1.20", MACAddress: "52:54:00:00:00:02", Labels: map[string]string{"team": "web"}},
+		{Name: "db1", IPAddress: "10.0.2.10", MACAddress: "52:54:00:00:00:03", Labels: map[string]string{"team": "db"}},
+		{Name: "web1", IPAddress: "10.0.1.9", MACAddress: "52:54:00:00:00:01", Labels: map[string]string{"team": "web"}},
+		{Name: "web10", IPAddress: "fd00::1", MACAddress: "52:54:00:00:00:04"},
+	} {
+		item := item
+		_, err := repo.Save(&item)
+		assert.Nil(t, err)
+	}
+	db1, err := repo.FindByMACAddress("52-54-00-00-00-03")
+	assert.Nil(t, err)
+	_, err = repo.Modify(db1.ID.Hex(), func(item *Instance) error {
+		item.RequestedAt = time.Now()
+		return nil
+	})
+	assert.Nil(t, err)
+
+	find := func(q *InstanceQuery) ([]string, int) {
+		items, total, err := repo.FindPage(q)
+		assert.Nil(t, err)
+		return names(items), total
+	}
+
+	result, total := find(&InstanceQuery{Sort: SortByName})
+	assert.Equal(t, []string{"db1", "web1", "web10", "web2"}, result)
+	assert.Equal(t, 4, total)
+
+	result, total = find(&InstanceQuery{Sort: SortByName, Descending: true, Page: 2, PageSize: 3})
+	assert.Equal(t, []string{"db1"}, result)
+	assert.Equal(t, 4, total)
+
+	result, _ = find(&InstanceQuery{Sort: SortByCreatedAt})
+	assert.Equal(t, []string{"web2", "db1", "web1", "web10"}, result)
+
+	// numeric, not lexical order
+	_, network, _ := net.ParseCIDR("10.0.1.0/24")
+	result, _ = find(&InstanceQuery{Sort: SortByIPAddress, Network: network})
+	assert.Equal(t, []string{"web1", "web2"}, result)
+	result, _ = find(&InstanceQuery{Sort: SortByIPAddress, Network: network, Descending: true})
+	assert.Equal(t, []string{"web2", "web1"}, result)
+	result, _ = find(&InstanceQuery{Sort: SortByName, Network: network})
+	assert.Equal(t, []string{"web1", "web2"}, result)
+
+	result, _ = find(&InstanceQuery{Sort: SortByName, NamePrefix: "web1"})
+	assert.Equal(t, []string{"web1", "web10"}, result)
+	result, _ = find(&InstanceQuery{Sort: SortByName, NamePrefix: "web1", Descending: true})
+	assert.Equal(t, []string{"web10", "web1"}, result)
+
+	result, _ = find(&InstanceQuery{MACAddress: "52:54:00:00:00:04"})
+	assert.Equal(t, []string{"web10"}, result)
+	team, _ := ParseSelector("team=web")
+	result, _ = find(&InstanceQuery{Sort: SortByName, Selector: team})
+	assert.Equal(t, []string{"web1", "web2"}, result)
+	result, _ = find(&InstanceQuery{Sort: SortByName, Selector: team, Scope: map[string]string{"team": "db"}})
+	assert.Empty(t, result)
+	notWeb, _ := ParseSelector("team!=web")
+	result, _ = find(&InstanceQuery{Sort: SortByName, Selector: notWeb})
+	assert.Equal(t, []string{"db1", "web10"}, result)
+
+	result, _ = find(&InstanceQuery{Sort: SortByRequestedAt, Descending: true})
+	assert.Equal(t, "db1", result[0])
+	result, _ = find(&InstanceQuery{Sort: SortByName, NeverRequested: true})
+	assert.Equal(t, []string{"web1", "web10", "web2"}, result)
+
+	// renaming and deleting keep the indexes in sync
+	db1.Name = "db2"
+	db1.Revision = 0
+	_, err = repo.Save(db1)
+	assert.Nil(t, err)
+	assert.Nil(t, repo.Delete(db1.ID.Hex(), 0, "test"))
+	result, _ = find(&InstanceQuery{Sort: SortByName, NamePrefix: "db"})
+	assert.Empty(t, result)
+	item, err := repo.FindByIPAddress("10.0.2.10")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+}
@@ -11,13 +11,43 @@ import (
 
 var instanceBucket = []byte("instances")
 
+// every saved version of an instance is kept in a nested bucket per
+// instance, keyed by revision
+var instanceRevisionBucket = []byte("instance-revisions")
+
 type InstanceRepository interface {
 	FindAll() ([]Instance, error)
 	FindOne(id string) (*Instance, error)
+	// FindPage returns a page of the instances matching the query and
+	// how many match in total
+	FindPage(query *InstanceQuery) ([]Instance, int, error)
 	FindByIPAddress(IPAddress string) (*Instance, error)
 	FindByMACAddress(MACAddress string) (*Instance, error)
+	// Save stores the instance under a new revision. The stored instance
+	// has to be at item.Revision, else ErrRevisionConflict is returned.
 	Save(item *Instance) (*Instance, error)
-	Delete(id string) error
+	FindRevisions(id string) ([]Revision, error)
+	// FindRevision returns ErrRevisionNotFound for unknown revisions
+	FindRevision(id string, revision uint64) (*Instance, error)
+	// Modify applies fn to the stored instance and saves the result
+	// atomically. It returns ErrInstanceNotFound for unknown IDs.
+	Modify(id string, fn func(item *Instance) error) (*Instance, error)
+	// Delete moves the instance to the trash if it's at the given
+	// revision, any revision for 0
+	Delete(id string, revision uint64, deletedBy string) error
+	FindTrash() ([]TrashedInstance, error)
+	// FindTrashed returns ErrInstanceNotFound unless the instance is in
+	// the trash
+	FindTrashed(id string) (*TrashedInstance, error)
+	// Undelete moves the instance from the trash back
+	Undelete(id string) (*Instance, error)
+	// Purge removes the instance from the trash along with its revisions
+	Purge(id string) error
+	// PurgeTrash purges the instances deleted before the given time
+	PurgeTrash(before time.Time) (int, error)
+	// Batch runs fn in a single transaction, which is rolled back when
+	// fn returns an error
+	Batch(fn func(batch InstanceBatch) error) error
 }
 
 type BoltInstanceRepository struct {
@@ -26,8 +56,16 @@ type BoltInstanceRepository struct {
 
 func NewInstanceRepository(db *bolt.DB) *BoltInstanceRepository {
 	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(instanceBucket)
-		return err
+		if _, err := tx.CreateBucketIfNotExists(instanceBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(instanceRevisionBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(instanceTrashBucket); err != nil {
+			return err
+		}
+		return createIndexes(tx)
 	})
 	return &BoltInstanceRepository{db}
 }
@@ -37,7 +75,7 @@ func (r *BoltInstanceRepository) FindAll() ([]Instance, error) {
 
 	err := r.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(instanceBucket)
-		b.ForEach(func(k, v []byte) error {
+		return b.ForEach(func(k, v []byte) error {
 			item, err := decode(v)
 			if err != nil {
 				return err
@@ -45,8 +83,6 @@ func (r *BoltInstanceRepository) FindAll() ([]Instance, error) {
 			items = append(items, *item)
 			return nil
 		})
-
-		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -58,17 +94,8 @@ func (r *BoltInstanceRepository) FindOne(id string) (*Instance, error) {
 	var item *Instance
 	err := r.db.View(func(tx *bolt.Tx) error {
 		var err error
-		b := tx.Bucket(instanceBucket)
-		k := []byte(id)
-		itemData := b.Get(k)
-		if len(itemData) == 0 {
-			return nil
-		}
-		item, err = decode(itemData)
-		if err != nil {
-			return err
-		}
-		return nil
+		item, err = getInstance(tx, id)
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -76,67 +103,187 @@ func (r *BoltInstanceRepository) FindOne(id string) (*Instance, error) {
 	return item, nil
 }
 
+// getInstance returns nil for unknown IDs
+func getInstance(tx *bolt.Tx, id string) (*Instance, error) {
+	itemData := tx.Bucket(instanceBucket).Get([]byte(id))
+	if len(itemData) == 0 {
+		return nil, nil
+	}
+	return decode(itemData)
+}
+
 func (r *BoltInstanceRepository) FindByIPAddress(IPAddress string) (*Instance, error) {
-	items, err := r.FindAll()
+	var item *Instance
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		item, err = findByIndex(tx, ipAddressIndex, ipKey(IPAddress))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// FindByMACAddress matches MAC addresses regardless of their notation
+func (r *BoltInstanceRepository) FindByMACAddress(MACAddress string) (*Instance, error) {
+	var item *Instance
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		item, err = findByIndex(tx, macAddressIndex, macKey(MACAddress))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, item := range items {
-		if item.IPAddress == IPAddress {
-			return &item, nil
+	return item, nil
+}
+
+func (r *BoltInstanceRepository) Save(item *Instance) (*Instance, error) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return saveInstance(tx, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func saveInstance(tx *bolt.Tx, item *Instance) error {
+	b := tx.Bucket(instanceBucket)
+	if item.ID == "" {
+		item.ID = bson.NewObjectId()
+		item.CreatedAt = time.Now()
+		item.UpdatedAt = time.Now()
+	}
+	stored := b.Get([]byte(item.ID.Hex()))
+	if err := checkRevision(stored, item.Revision); err != nil {
+		return err
+	}
+	var old *Instance
+	if len(stored) > 0 {
+		var err error
+		if old, err = decode(stored); err != nil {
+			return err
 		}
 	}
-	return nil, nil
+	revisions, err := tx.Bucket(instanceRevisionBucket).CreateBucketIfNotExists([]byte(item.ID.Hex()))
+	if err != nil {
+		return err
+	}
+	enc, err := putRevision(revisions, func(revision uint64) ([]byte, error) {
+		item.Revision = revision
+		return item.encode()
+	})
+	if err != nil {
+		return err
+	}
+	if err := updateIndexes(tx, old, item); err != nil {
+		return err
+	}
+	return b.Put([]byte(item.ID.Hex()), enc)
 }
 
-func (r *BoltInstanceRepository) FindByMACAddress(MACAddress string) (*Instance, error) {
-	items, err := r.FindAll()
+func (r *BoltInstanceRepository) FindRevisions(id string) ([]Revision, error) {
+	var items []Revision
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		items, err = listRevisions(tx.Bucket(instanceRevisionBucket).Bucket([]byte(id)))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, item := range items {
-		if item.MACAddress == MACAddress {
-			return &item, nil
+	return items, nil
+}
+
+func (r *BoltInstanceRepository) FindRevision(id string, revision uint64) (*Instance, error) {
+	var item *Instance
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		itemData := getRevision(tx.Bucket(instanceRevisionBucket).Bucket([]byte(id)), revision)
+		if len(itemData) == 0 {
+			return ErrRevisionNotFound
 		}
+		item, err = decode(itemData)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	return item, nil
 }
 
-func (r *BoltInstanceRepository) Save(item *Instance) (*Instance, error) {
+func (r *BoltInstanceRepository) Modify(id string, fn func(item *Instance) error) (*Instance, error) {
+	var item *Instance
 	err := r.db.Update(func(tx *bolt.Tx) error {
+		var err error
 		b := tx.Bucket(instanceBucket)
-		if item.ID == "" {
-			item.ID = bson.NewObjectId()
-			item.CreatedAt = time.Now()
-			item.UpdatedAt = time.Now()
-			enc, err := item.encode()
-			if err != nil {
-				return err
-			}
-			return b.Put([]byte(item.ID.Hex()), enc)
-		} else {
-			enc, err := item.encode()
-			if err != nil {
-				return err
-			}
-			return b.Put([]byte(item.ID.Hex()), enc)
+		k := []byte(id)
+		itemData := b.Get(k)
+		if len(itemData) == 0 {
+			return ErrInstanceNotFound
 		}
+		old, err := decode(itemData)
+		if err != nil {
+			return err
+		}
+		item, err = decode(itemData)
+		if err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+		enc, err := item.encode()
+		if err != nil {
+			return err
+		}
+		if err := updateIndexes(tx, old, item); err != nil {
+			return err
+		}
+		return b.Put(k, enc)
 	})
 	if err != nil {
 		return nil, err
 	}
-
 	return item, nil
 }
 
-func (r *BoltInstanceRepository) Delete(id string) error {
+func (r *BoltInstanceRepository) Delete(id string, revision uint64, deletedBy string) error {
 	return r.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(instanceBucket)
-		k := []byte(id)
-		return b.Delete(k)
+		return deleteInstance(tx, id, revision, deletedBy)
 	})
 }
 
+func deleteInstance(tx *bolt.Tx, id string, revision uint64, deletedBy string) error {
+	b := tx.Bucket(instanceBucket)
+	k := []byte(id)
+	itemData := b.Get(k)
+	if len(itemData) == 0 {
+		return nil
+	}
+	if err := checkRevision(itemData, revision); err != nil {
+		return err
+	}
+	item, err := decode(itemData)
+	if err != nil {
+		return err
+	}
+	enc, err := json.Marshal(&TrashedInstance{Instance: *item, DeletedAt: time.Now(), DeletedBy: deletedBy})
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(instanceTrashBucket).Put(k, enc); err != nil {
+		return err
+	}
+	if err := updateIndexes(tx, item, nil); err != nil {
+		return err
+	}
+	return b.Delete(k)
+}
+
 func (p *Instance) encode() ([]byte, error) {
 	enc, err := json.Marshal(p)
 	if err != nil {
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHosts renders an OpenSSH known_hosts file from the host keys the
+// instances reported through phone_home. Each key is listed for the
+// instance name, IP address and reported hostnames. With hashed, every
+// host gets its own hashed line like ssh-keygen -H writes them.
+func KnownHosts(items []Instance, hashed bool) ([]byte, error) {
+	sorted := make([]Instance, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	buf := new(bytes.Buffer)
+	for _, item := range sorted {
+		if len(item.SSHHostKeys) == 0 {
+			continue
+		}
+		hosts := item.knownHostNames()
+		keyTypes := make([]string, 0, len(item.SSHHostKeys))
+		for keyType := range item.SSHHostKeys {
+			keyTypes = append(keyTypes, keyType)
+		}
+		sort.Strings(keyTypes)
+
+		// the comment would give away the name a hashed line hides
+		if !hashed {
+			buf.WriteString("# " + item.Name + "\n")
+		}
+		for _, keyType := range keyTypes {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(item.SSHHostKeys[keyType]))
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s host key of %s", keyType, item.Name)
+			}
+			if !hashed {
+				buf.WriteString(knownhosts.Line(hosts, key) + "\n")
+				continue
+			}
+			serialized := ssh.MarshalAuthorizedKey(key)
+			for _, host := range hosts {
+				buf.WriteString(knownhosts.HashHostname(knownhosts.Normalize(host)) + " ")
+				buf.Write(serialized)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *Instance) knownHostNames() []string {
+	seen := make(map[string]bool)
+	hosts := []string{}
+	for _, host := range []string{p.Name, p.ReportedHostname, p.ReportedFQDN, p.IPAddress} {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKnownHosts(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	items := []Instance{{
+		Name:         "web1",
+		IPAddress:    "10.0.0.1",
+		ReportedFQDN: "web1.example.com",
+		SSHHostKeys:  map[string]string{"ed25519": string(ssh.MarshalAuthorizedKey(key))},
+	}}
+
+	plain, err := KnownHosts(items, false)
+	assert.Nil(t, err)
+	assert.Contains(t, string(plain), "# web1\n")
+	assert.Contains(t, string(plain), "web1,web1.example.com,10.0.0.1 ssh-ed25519 ")
+
+	hashed, err := KnownHosts(items, true)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(hashed)), "\n")
+	assert.Len(t, lines, 3)
+	for _, host := range []string{"web1", "example.com", "10.0.0.1"} {
+		assert.NotContains(t, string(hashed), host)
+	}
+}
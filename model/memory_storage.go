@@ -0,0 +1,95 @@
+package model
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// memoryStore keeps the records in memory only, e.g. for tests and
+// short-lived labs. Transactions see a consistent state, writes are
+// made on copies of the kinds they touch and swapped in on commit.
+type memoryStore struct {
+	mu    sync.RWMutex
+	kinds map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{kinds: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) View(fn func(tx recordTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memoryTx{kinds: s.kinds})
+}
+
+func (s *memoryStore) Update(fn func(tx recordTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memoryTx{kinds: s.kinds, changed: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for kind, records := range tx.changed {
+		s.kinds[kind] = records
+	}
+	return nil
+}
+
+type memoryTx struct {
+	kinds map[string]map[string][]byte
+	// changed holds the copies of the kinds written, nil for reads only
+	changed map[string]map[string][]byte
+}
+
+func (tx *memoryTx) records(kind string) map[string][]byte {
+	if records, ok := tx.changed[kind]; ok {
+		return records
+	}
+	return tx.kinds[kind]
+}
+
+// writable copies the kind on its first write
+func (tx *memoryTx) writable(kind string) map[string][]byte {
+	if records, ok := tx.changed[kind]; ok {
+		return records
+	}
+	records := make(map[string][]byte, len(tx.kinds[kind]))
+	for k, v := range tx.kinds[kind] {
+		records[k] = v
+	}
+	tx.changed[kind] = records
+	return records
+}
+
+func (tx *memoryTx) Get(kind string, key []byte) ([]byte, error) {
+	return tx.records(kind)[string(key)], nil
+}
+
+func (tx *memoryTx) Put(kind string, key, value []byte) error {
+	tx.writable(kind)[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (tx *memoryTx) Delete(kind string, key []byte) error {
+	delete(tx.writable(kind), string(key))
+	return nil
+}
+
+func (tx *memoryTx) ForEach(kind string, prefix []byte, fn func(key, value []byte) error) error {
+	records := tx.records(kind)
+	var keys []string
+	for k := range records {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k), records[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
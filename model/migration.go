@@ -0,0 +1,205 @@
+package model
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// metaBucket holds the schema version of the database
+var metaBucket = []byte("meta")
+var schemaVersionKey = []byte("schema-version")
+
+// ErrSchemaTooNew is returned for databases written by a newer version,
+// which this one may not read correctly
+var ErrSchemaTooNew = errors.New("the database schema is newer than this version supports")
+
+var errMigrationDryRun = errors.New("dry run")
+
+// migration moves the database from the previous schema version to its
+// own. Migrations are never changed once released, the next change gets
+// a new one.
+type migration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations by schema version, starting at 1. Databases without a
+// version are at 0.
+var migrations = []migration{
+	{"create the buckets", createBuckets},
+	{"index the instances", createIndexes},
+	{"start the revision history of records saved before revisions", startRevisions},
+	{"store the status of instances saved before statuses", storePendingStatus},
+	{"index the instances by creation time", createCreatedAtIndex},
+}
+
+// SchemaVersion is the schema version this version writes
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// MigrationStep is a migration applied, or pending for a dry run
+type MigrationStep struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// ReadSchemaVersion returns the schema version of the database
+func ReadSchemaVersion(db *bolt.DB) (int, error) {
+	version := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return 0
+	}
+	v := b.Get(schemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+// Migrate brings the database to the current schema version in a single
+// transaction and returns the migrations applied. A dry run rolls them
+// back. It fails with ErrSchemaTooNew for newer databases.
+func Migrate(db *bolt.DB, dryRun bool) ([]MigrationStep, error) {
+	var steps []MigrationStep
+	err := db.Update(func(tx *bolt.Tx) error {
+		version := schemaVersion(tx)
+		if version > SchemaVersion() {
+			return errors.Wrapf(ErrSchemaTooNew, "database at version %d, supported up to %d", version, SchemaVersion())
+		}
+		for i := version; i < SchemaVersion(); i++ {
+			if err := migrations[i].migrate(tx); err != nil {
+				return errors.Wrapf(err, "migrating to version %d, %s", i+1, migrations[i].description)
+			}
+			steps = append(steps, MigrationStep{Version: i + 1, Description: migrations[i].description})
+		}
+		if len(steps) == 0 {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(schemaVersionKey, sequenceKey(uint64(SchemaVersion()))); err != nil {
+			return err
+		}
+		if dryRun {
+			return errMigrationDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errMigrationDryRun {
+		return nil, err
+	}
+	return steps, nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	buckets := [][]byte{
+		instanceBucket, instanceRevisionBucket, instanceTrashBucket,
+		environmentBucket, environmentRevisionBucket,
+		tokenBucket, auditBucket, eventBucket, fetchBucket,
+	}
+	for _, name := range buckets {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startRevisions stores the instances and the environment saved before
+// revisions were kept as their first revision
+func startRevisions(tx *bolt.Tx) error {
+	b := tx.Bucket(instanceBucket)
+	var items []*Instance
+	err := b.ForEach(func(k, v []byte) error {
+		item, err := decode(v)
+		if err != nil {
+			return err
+		}
+		if item.Revision == 0 {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		revisions, err := tx.Bucket(instanceRevisionBucket).CreateBucketIfNotExists([]byte(item.ID.Hex()))
+		if err != nil {
+			return err
+		}
+		enc, err := putRevision(revisions, func(revision uint64) ([]byte, error) {
+			item.Revision = revision
+			return item.encode()
+		})
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(item.ID.Hex()), enc); err != nil {
+			return err
+		}
+	}
+
+	env := tx.Bucket(environmentBucket)
+	itemData := env.Get(environmentKey)
+	if len(itemData) == 0 {
+		return nil
+	}
+	item, err := decodeEnvironment(itemData)
+	if err != nil || item.Revision != 0 {
+		return err
+	}
+	enc, err := putRevision(tx.Bucket(environmentRevisionBucket), func(revision uint64) ([]byte, error) {
+		item.Revision = revision
+		return item.encodeEnvironment()
+	})
+	if err != nil {
+		return err
+	}
+	return env.Put(environmentKey, enc)
+}
+
+// storePendingStatus makes instances saved before statuses pending, as
+// of their creation
+func storePendingStatus(tx *bolt.Tx) error {
+	b := tx.Bucket(instanceBucket)
+	var items []*Instance
+	err := b.ForEach(func(k, v []byte) error {
+		item, err := decode(v)
+		if err != nil {
+			return err
+		}
+		if item.Status == "" {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		item.setStatus(StatusPending, item.CreatedAt)
+		enc, err := item.encode()
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(item.ID.Hex()), enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
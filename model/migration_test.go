@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	// an instance saved before revisions, statuses and indexes
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(instanceBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("0123456789abcdef01234567"),
+			[]byte(`{"id":"0123456789abcdef01234567","name":"web1","ipAddress":"10.0.0.1","macAddress":"00:00:00:00:00:01"}`))
+	})
+	assert.Nil(t, err)
+
+	steps, err := Migrate(db, true)
+	assert.Nil(t, err)
+	assert.Len(t, steps, SchemaVersion())
+	version, err := ReadSchemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, version)
+
+	steps, err = Migrate(db, false)
+	assert.Nil(t, err)
+	assert.Len(t, steps, SchemaVersion())
+	version, err = ReadSchemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion(), version)
+
+	repo := NewInstanceRepository(db)
+	item, err := repo.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), item.Revision)
+	assert.Equal(t, StatusPending, item.Status)
+	revisions, err := repo.FindRevisions("0123456789abcdef01234567")
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 1)
+
+	steps, err = Migrate(db, false)
+	assert.Nil(t, err)
+	assert.Empty(t, steps)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, sequenceKey(uint64(SchemaVersion()+1)))
+	})
+	assert.Nil(t, err)
+	_, err = Migrate(db, false)
+	assert.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+}
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrInstanceMismatch = errors.New("caller does not match instance")
+
+// PhoneHomeReport is what cloud-init's phone_home module posts once
+// the instance is up
+type PhoneHomeReport struct {
+	InstanceID string
+	Hostname   string
+	FQDN       string
+	// HostKeys maps the key type reported by cloud-init (rsa, ecdsa,
+	// ed25519, ...) to the public key in authorized_keys format
+	HostKeys map[string]string
+}
+
+// PhoneHome records the report of the instance with the given IP
+// address and marks its provisioning as finished. The instance-id the
+// guest reports, in the report or as id, comes from meta-data written
+// by users, so it's only recorded and doesn't identify the guest.
+func (c *InstanceServiceImpl) PhoneHome(ipAddress, id string, report *PhoneHomeReport) (*Instance, error) {
+	keys := make(map[string]string)
+	for keyType, key := range report.HostKeys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s host key", keyType)
+		}
+		keys[keyType] = key
+	}
+
+	item, err := c.FindForClient(ipAddress, "")
+	if err != nil {
+		return nil, err
+	}
+	instanceID := report.InstanceID
+	if instanceID == "" {
+		instanceID = id
+	}
+
+	return c.Repository.Modify(item.ID.Hex(), func(item *Instance) error {
+		now := time.Now()
+		item.SSHHostKeys = keys
+		item.ReportedHostname = report.Hostname
+		item.ReportedFQDN = report.FQDN
+		item.ReportedInstanceID = instanceID
+		item.PhoneHomeAt = now
+		item.advance(StatusFinished, now)
+		return nil
+	})
+}
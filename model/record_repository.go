@@ -0,0 +1,614 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// recordStore keeps JSON records by kind and key, for the storage
+// drivers other than Bolt. The records are laid out like the Bolt
+// buckets, so the repositories behave the same on every driver.
+type recordStore interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx recordTx) error) error
+	// Update runs fn in a transaction, which is rolled back when fn
+	// returns an error
+	Update(fn func(tx recordTx) error) error
+}
+
+type recordTx interface {
+	// Get returns nil for unknown keys
+	Get(kind string, key []byte) ([]byte, error)
+	Put(kind string, key, value []byte) error
+	Delete(kind string, key []byte) error
+	// ForEach visits the records of a kind whose key starts with prefix,
+	// ordered by key
+	ForEach(kind string, prefix []byte, fn func(key, value []byte) error) error
+}
+
+// the record kinds, named like the Bolt buckets
+var (
+	instanceKind            = string(instanceBucket)
+	instanceRevisionKind    = string(instanceRevisionBucket)
+	instanceTrashKind       = string(instanceTrashBucket)
+	environmentKind         = string(environmentBucket)
+	environmentRevisionKind = string(environmentRevisionBucket)
+)
+
+// revisionKey is the key of a revision of the instance with the given
+// ID, the environment's have an empty ID
+func revisionKey(id string, revision uint64) []byte {
+	return append(revisionPrefix(id), sequenceKey(revision)...)
+}
+
+func revisionPrefix(id string) []byte {
+	if id == "" {
+		return nil
+	}
+	return append([]byte(id), keySeparator)
+}
+
+// putRecordRevision stores the copy encoded for the revision after the
+// last one of the ID and returns the encoded copy
+func putRecordRevision(tx recordTx, kind, id string, encode func(revision uint64) ([]byte, error)) ([]byte, error) {
+	var last uint64
+	err := tx.ForEach(kind, revisionPrefix(id), func(k, v []byte) error {
+		var header revisionHeader
+		if err := json.Unmarshal(v, &header); err != nil {
+			return err
+		}
+		last = header.Revision
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encode(last + 1)
+	if err != nil {
+		return nil, err
+	}
+	return enc, tx.Put(kind, revisionKey(id, last+1), enc)
+}
+
+func listRecordRevisions(tx recordTx, kind, id string) ([]Revision, error) {
+	items := []Revision{}
+	err := tx.ForEach(kind, revisionPrefix(id), func(k, v []byte) error {
+		var header revisionHeader
+		if err := json.Unmarshal(v, &header); err != nil {
+			return err
+		}
+		items = append(items, Revision{Revision: header.Revision, SavedAt: header.UpdatedAt})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// RecordInstanceRepository keeps the instances in a recordStore
+type RecordInstanceRepository struct {
+	store recordStore
+	// db keeps the events and fetches of the instances, which are
+	// dropped along with purged instances
+	db *bolt.DB
+}
+
+func NewRecordInstanceRepository(store recordStore, db *bolt.DB) *RecordInstanceRepository {
+	return &RecordInstanceRepository{store, db}
+}
+
+func (r *RecordInstanceRepository) FindAll() ([]Instance, error) {
+	var items []Instance
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		items, err = findAllRecords(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func findAllRecords(tx recordTx) ([]Instance, error) {
+	items := []Instance{}
+	err := tx.ForEach(instanceKind, nil, func(k, v []byte) error {
+		item, err := decode(v)
+		if err != nil {
+			return err
+		}
+		items = append(items, *item)
+		return nil
+	})
+	return items, err
+}
+
+func (r *RecordInstanceRepository) FindOne(id string) (*Instance, error) {
+	var item *Instance
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		item, err = getInstanceRecord(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// getInstanceRecord returns nil for unknown IDs
+func getInstanceRecord(tx recordTx, id string) (*Instance, error) {
+	itemData, err := tx.Get(instanceKind, []byte(id))
+	if err != nil || len(itemData) == 0 {
+		return nil, err
+	}
+	return decode(itemData)
+}
+
+func (r *RecordInstanceRepository) FindPage(query *InstanceQuery) ([]Instance, int, error) {
+	all, err := r.FindAll()
+	if err != nil {
+		return nil, 0, err
+	}
+	items, total := findPage(all, query)
+	return items, total, nil
+}
+
+func (r *RecordInstanceRepository) FindByIPAddress(IPAddress string) (*Instance, error) {
+	var item *Instance
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		item, err = findRecordBy(tx, ipKey, IPAddress, func(p *Instance) string { return p.IPAddress })
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// FindByMACAddress matches MAC addresses regardless of their notation
+func (r *RecordInstanceRepository) FindByMACAddress(MACAddress string) (*Instance, error) {
+	var item *Instance
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		item, err = findRecordBy(tx, macKey, MACAddress, func(p *Instance) string { return p.MACAddress })
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// findRecordBy scans the instances for the one whose field has the same
+// key as value, nil if there is none
+func findRecordBy(tx recordTx, key func(string) []byte, value string, field func(p *Instance) string) (*Instance, error) {
+	want := key(value)
+	if want == nil {
+		return nil, nil
+	}
+	items, err := findAllRecords(tx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if bytes.Equal(key(field(&items[i])), want) {
+			return &items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *RecordInstanceRepository) Save(item *Instance) (*Instance, error) {
+	err := r.store.Update(func(tx recordTx) error {
+		return saveInstanceRecord(tx, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func saveInstanceRecord(tx recordTx, item *Instance) error {
+	if item.ID == "" {
+		item.ID = bson.NewObjectId()
+		item.CreatedAt = time.Now()
+		item.UpdatedAt = time.Now()
+	}
+	id := item.ID.Hex()
+	stored, err := tx.Get(instanceKind, []byte(id))
+	if err != nil {
+		return err
+	}
+	if err := checkRevision(stored, item.Revision); err != nil {
+		return err
+	}
+	enc, err := putRecordRevision(tx, instanceRevisionKind, id, func(revision uint64) ([]byte, error) {
+		item.Revision = revision
+		return item.encode()
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Put(instanceKind, []byte(id), enc)
+}
+
+func (r *RecordInstanceRepository) FindRevisions(id string) ([]Revision, error) {
+	var items []Revision
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		items, err = listRecordRevisions(tx, instanceRevisionKind, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *RecordInstanceRepository) FindRevision(id string, revision uint64) (*Instance, error) {
+	var item *Instance
+	err := r.store.View(func(tx recordTx) error {
+		itemData, err := tx.Get(instanceRevisionKind, revisionKey(id, revision))
+		if err != nil {
+			return err
+		}
+		if len(itemData) == 0 {
+			return ErrRevisionNotFound
+		}
+		item, err = decode(itemData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *RecordInstanceRepository) Modify(id string, fn func(item *Instance) error) (*Instance, error) {
+	var item *Instance
+	err := r.store.Update(func(tx recordTx) error {
+		var err error
+		if item, err = getInstanceRecord(tx, id); err != nil {
+			return err
+		}
+		if item == nil {
+			return ErrInstanceNotFound
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+		enc, err := item.encode()
+		if err != nil {
+			return err
+		}
+		return tx.Put(instanceKind, []byte(id), enc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *RecordInstanceRepository) Delete(id string, revision uint64, deletedBy string) error {
+	return r.store.Update(func(tx recordTx) error {
+		return deleteInstanceRecord(tx, id, revision, deletedBy)
+	})
+}
+
+func deleteInstanceRecord(tx recordTx, id string, revision uint64, deletedBy string) error {
+	k := []byte(id)
+	itemData, err := tx.Get(instanceKind, k)
+	if err != nil || len(itemData) == 0 {
+		return err
+	}
+	if err := checkRevision(itemData, revision); err != nil {
+		return err
+	}
+	item, err := decode(itemData)
+	if err != nil {
+		return err
+	}
+	enc, err := json.Marshal(&TrashedInstance{Instance: *item, DeletedAt: time.Now(), DeletedBy: deletedBy})
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(instanceTrashKind, k, enc); err != nil {
+		return err
+	}
+	return tx.Delete(instanceKind, k)
+}
+
+func (r *RecordInstanceRepository) FindTrash() ([]TrashedInstance, error) {
+	items := []TrashedInstance{}
+	err := r.store.View(func(tx recordTx) error {
+		return tx.ForEach(instanceTrashKind, nil, func(k, v []byte) error {
+			var item TrashedInstance
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *RecordInstanceRepository) FindTrashed(id string) (*TrashedInstance, error) {
+	var item *TrashedInstance
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		item, err = getTrashedRecord(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *RecordInstanceRepository) Undelete(id string) (*Instance, error) {
+	var item *Instance
+	err := r.store.Update(func(tx recordTx) error {
+		var err error
+		item, err = undeleteInstanceRecord(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func undeleteInstanceRecord(tx recordTx, id string) (*Instance, error) {
+	trashed, err := getTrashedRecord(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	item := &trashed.Instance
+	enc, err := item.encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Put(instanceKind, []byte(id), enc); err != nil {
+		return nil, err
+	}
+	return item, tx.Delete(instanceTrashKind, []byte(id))
+}
+
+func (r *RecordInstanceRepository) Purge(id string) error {
+	err := r.store.Update(func(tx recordTx) error {
+		if _, err := getTrashedRecord(tx, id); err != nil {
+			return err
+		}
+		return purgeRecord(tx, id)
+	})
+	if err != nil {
+		return err
+	}
+	return r.deleteHistory([]string{id})
+}
+
+func (r *RecordInstanceRepository) PurgeTrash(before time.Time) (int, error) {
+	var old []string
+	err := r.store.Update(func(tx recordTx) error {
+		old = nil
+		err := tx.ForEach(instanceTrashKind, nil, func(k, v []byte) error {
+			var item TrashedInstance
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if item.DeletedAt.Before(before) {
+				old = append(old, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range old {
+			if err := purgeRecord(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(old), r.deleteHistory(old)
+}
+
+// deleteHistory drops the events and fetches of purged instances from
+// the Bolt database, once they are gone from the store
+func (r *RecordInstanceRepository) deleteHistory(ids []string) error {
+	if r.db == nil || len(ids) == 0 {
+		return nil
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if err := deleteHistory(tx, []byte(id), eventBucket, fetchBucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *RecordInstanceRepository) Batch(fn func(batch InstanceBatch) error) error {
+	return r.store.Update(func(tx recordTx) error {
+		return fn(&recordInstanceBatch{tx})
+	})
+}
+
+func getTrashedRecord(tx recordTx, id string) (*TrashedInstance, error) {
+	itemData, err := tx.Get(instanceTrashKind, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(itemData) == 0 {
+		return nil, ErrInstanceNotFound
+	}
+	var item TrashedInstance
+	if err := json.Unmarshal(itemData, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// purgeRecord removes a trashed instance and its revisions
+func purgeRecord(tx recordTx, id string) error {
+	if err := tx.Delete(instanceTrashKind, []byte(id)); err != nil {
+		return err
+	}
+	var revisions [][]byte
+	err := tx.ForEach(instanceRevisionKind, revisionPrefix(id), func(k, v []byte) error {
+		revisions = append(revisions, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range revisions {
+		if err := tx.Delete(instanceRevisionKind, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordInstanceBatch works on the write transaction of a batch
+type recordInstanceBatch struct {
+	tx recordTx
+}
+
+func (b *recordInstanceBatch) FindOne(id string) (*Instance, error) {
+	return getInstanceRecord(b.tx, id)
+}
+
+func (b *recordInstanceBatch) InTrash(id string) (bool, error) {
+	itemData, err := b.tx.Get(instanceTrashKind, []byte(id))
+	return len(itemData) > 0, err
+}
+
+func (b *recordInstanceBatch) FindTrashed(id string) (*TrashedInstance, error) {
+	return getTrashedRecord(b.tx, id)
+}
+
+func (b *recordInstanceBatch) FindByIPAddress(IPAddress string) (*Instance, error) {
+	return findRecordBy(b.tx, ipKey, IPAddress, func(p *Instance) string { return p.IPAddress })
+}
+
+func (b *recordInstanceBatch) FindByMACAddress(MACAddress string) (*Instance, error) {
+	return findRecordBy(b.tx, macKey, MACAddress, func(p *Instance) string { return p.MACAddress })
+}
+
+func (b *recordInstanceBatch) Save(item *Instance) (*Instance, error) {
+	if err := saveInstanceRecord(b.tx, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (b *recordInstanceBatch) Delete(id string, revision uint64, deletedBy string) error {
+	return deleteInstanceRecord(b.tx, id, revision, deletedBy)
+}
+
+func (b *recordInstanceBatch) Undelete(id string) (*Instance, error) {
+	return undeleteInstanceRecord(b.tx, id)
+}
+
+// RecordEnvironmentRepository keeps the environment in a recordStore
+type RecordEnvironmentRepository struct {
+	store recordStore
+}
+
+func NewRecordEnvironmentRepository(store recordStore) *RecordEnvironmentRepository {
+	return &RecordEnvironmentRepository{store}
+}
+
+func (r *RecordEnvironmentRepository) Get() (*Environment, error) {
+	var item *Environment
+	err := r.store.View(func(tx recordTx) error {
+		itemData, err := tx.Get(environmentKind, environmentKey)
+		if err != nil {
+			return err
+		}
+		if len(itemData) == 0 {
+			item = &Environment{UpdatedAt: time.Now()}
+			return nil
+		}
+		item, err = decodeEnvironment(itemData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *RecordEnvironmentRepository) Save(item *Environment) (*Environment, error) {
+	err := r.store.Update(func(tx recordTx) error {
+		stored, err := tx.Get(environmentKind, environmentKey)
+		if err != nil {
+			return err
+		}
+		if err := checkRevision(stored, item.Revision); err != nil {
+			return err
+		}
+		item.UpdatedAt = time.Now()
+		enc, err := putRecordRevision(tx, environmentRevisionKind, "", func(revision uint64) ([]byte, error) {
+			item.Revision = revision
+			return item.encodeEnvironment()
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Put(environmentKind, environmentKey, enc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *RecordEnvironmentRepository) FindRevisions() ([]Revision, error) {
+	var items []Revision
+	err := r.store.View(func(tx recordTx) error {
+		var err error
+		items, err = listRecordRevisions(tx, environmentRevisionKind, "")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *RecordEnvironmentRepository) FindRevision(revision uint64) (*Environment, error) {
+	var item *Environment
+	err := r.store.View(func(tx recordTx) error {
+		itemData, err := tx.Get(environmentRevisionKind, revisionKey("", revision))
+		if err != nil {
+			return err
+		}
+		if len(itemData) == 0 {
+			return ErrRevisionNotFound
+		}
+		item, err = decodeEnvironment(itemData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+	// ErrRevisionConflict is returned when saving over a revision other
+	// than the current one
+	ErrRevisionConflict = errors.New("revision conflict, it was changed in the meantime")
+)
+
+// Revision describes a saved version of an instance or the environment.
+// Every save stores a copy under the next revision number, older
+// revisions are never changed.
+type Revision struct {
+	Revision uint64    `json:"revision"`
+	SavedAt  time.Time `json:"savedAt"`
+}
+
+// revisionHeader decodes the fields of a stored copy a listing needs
+type revisionHeader struct {
+	Revision  uint64    `json:"revision"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// checkRevision fails with ErrRevisionConflict unless the stored copy is
+// at the given revision. Revision 0 and nothing stored skip the check.
+func checkRevision(stored []byte, revision uint64) error {
+	if len(stored) == 0 || revision == 0 {
+		return nil
+	}
+	var header revisionHeader
+	if err := json.Unmarshal(stored, &header); err != nil {
+		return err
+	}
+	if header.Revision != revision {
+		return ErrRevisionConflict
+	}
+	return nil
+}
+
+// putRevision stores the copy encoded for the next revision number of
+// the bucket and returns the encoded copy to save as the current version
+func putRevision(b *bolt.Bucket, encode func(revision uint64) ([]byte, error)) ([]byte, error) {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encode(seq)
+	if err != nil {
+		return nil, err
+	}
+	return enc, b.Put(sequenceKey(seq), enc)
+}
+
+// listRevisions lists the revisions in the bucket, which may be nil
+func listRevisions(b *bolt.Bucket) ([]Revision, error) {
+	items := []Revision{}
+	if b == nil {
+		return items, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		var header revisionHeader
+		if err := json.Unmarshal(v, &header); err != nil {
+			return err
+		}
+		items = append(items, Revision{Revision: header.Revision, SavedAt: header.UpdatedAt})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// getRevision returns the stored copy of a revision, nil if it doesn't
+// exist. The bucket may be nil.
+func getRevision(b *bolt.Bucket, revision uint64) []byte {
+	if b == nil {
+		return nil
+	}
+	return b.Get(sequenceKey(revision))
+}
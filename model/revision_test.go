@@ -0,0 +1,64 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "cloud-initer")
+	assert.Nil(t, err)
+	db, err := bolt.Open(filepath.Join(dir, "test.bolt"), 0600, nil)
+	assert.Nil(t, err)
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInstanceRevisions(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	repo := NewInstanceRepository(db)
+
+	item, err := repo.Save(&Instance{Name: "web1", UserData: "v1"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), item.Revision)
+
+	stale := *item
+	item.UserData = "v2"
+	item, err = repo.Save(item)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), item.Revision)
+
+	// saving over revision 1 would lose v2
+	stale.UserData = "v3"
+	_, err = repo.Save(&stale)
+	assert.Equal(t, ErrRevisionConflict, err)
+	assert.Equal(t, ErrRevisionConflict, repo.Delete(item.ID.Hex(), 1, "test"))
+
+	revisions, err := repo.FindRevisions(item.ID.Hex())
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+
+	old, err := repo.FindRevision(item.ID.Hex(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", old.UserData)
+	_, err = repo.FindRevision(item.ID.Hex(), 3)
+	assert.Equal(t, ErrRevisionNotFound, err)
+
+	// deleted instances keep their revisions until purged
+	assert.Nil(t, repo.Delete(item.ID.Hex(), 2, "test"))
+	revisions, err = repo.FindRevisions(item.ID.Hex())
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	assert.Nil(t, repo.Purge(item.ID.Hex()))
+	revisions, err = repo.FindRevisions(item.ID.Hex())
+	assert.Nil(t, err)
+	assert.Empty(t, revisions)
+}
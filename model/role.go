@@ -0,0 +1,112 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Role is a named set of permissions granted to a principal
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Permission allows a single kind of operation on the management API
+type Permission string
+
+const (
+	PermissionReadInstances   Permission = "instances:read"
+	PermissionWriteInstances  Permission = "instances:write"
+	PermissionEditEnvironment Permission = "environment:write"
+	PermissionRevealSecrets   Permission = "secrets:reveal"
+	PermissionManageTokens    Permission = "tokens:manage"
+	PermissionReadAudit       Permission = "audit:read"
+	PermissionBackup          Permission = "database:backup"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {
+		PermissionReadInstances,
+	},
+	RoleOperator: {
+		PermissionReadInstances,
+		PermissionWriteInstances,
+		PermissionRevealSecrets,
+	},
+	RoleAdmin: {
+		PermissionReadInstances,
+		PermissionWriteInstances,
+		PermissionEditEnvironment,
+		PermissionRevealSecrets,
+		PermissionManageTokens,
+		PermissionReadAudit,
+		PermissionBackup,
+	},
+}
+
+// Valid reports whether r is one of the known roles
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Can reports whether the role grants the permission
+func (r Role) Can(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller of the management API
+type Principal struct {
+	Name string
+	Role Role
+	// Scope restricts the principal to instances carrying all of these
+	// labels. An empty scope gives access to every instance.
+	Scope map[string]string
+}
+
+func (p *Principal) Can(permission Permission) bool {
+	return p.Role.Can(permission)
+}
+
+// CanAccess reports whether the instance is within the principal's scope
+func (p *Principal) CanAccess(item *Instance) bool {
+	for k, v := range p.Scope {
+		if item.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Covers reports whether a scope holds every label of the principal's
+// scope, so it reaches no instance the principal can't
+func (p *Principal) Covers(scope map[string]string) bool {
+	for k, v := range p.Scope {
+		if scope[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLabels parses "key=value" pairs as used on the command line
+func ParseLabels(pairs []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid label '%s', expected key=value", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
@@ -0,0 +1,182 @@
+package model
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SelectorOperator compares a label with the values of a requirement
+type SelectorOperator string
+
+const (
+	SelectorEquals       SelectorOperator = "="
+	SelectorNotEquals    SelectorOperator = "!="
+	SelectorIn           SelectorOperator = "in"
+	SelectorNotIn        SelectorOperator = "notin"
+	SelectorExists       SelectorOperator = "exists"
+	SelectorDoesNotExist SelectorOperator = "!"
+)
+
+// Requirement is a single condition of a selector
+type Requirement struct {
+	Key      string
+	Operator SelectorOperator
+	Values   []string
+}
+
+// Selector selects instances by their labels like Kubernetes label
+// selectors do, e.g. "role in (web,api),dc!=ams1,!legacy". All
+// requirements have to match, an empty selector matches everything.
+type Selector []Requirement
+
+var (
+	labelPattern       = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+	labelValuePattern  = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?)?$`)
+	setRequirementExpr = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+// ParseSelector parses a comma separated list of requirements:
+//
+//	key=value, key==value  the label has the value
+//	key!=value             the label is missing or has another value
+//	key in (v1,v2)         the label has one of the values
+//	key notin (v1,v2)      the label is missing or has none of the values
+//	key                    the label exists
+//	!key                   the label doesn't exist
+func ParseSelector(s string) (Selector, error) {
+	selector := Selector{}
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, *r)
+	}
+	return selector, nil
+}
+
+// splitRequirements splits at the commas outside of parentheses
+func splitRequirements(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(s string) (*Requirement, error) {
+	r := &Requirement{}
+	if m := setRequirementExpr.FindStringSubmatch(s); m != nil {
+		r.Key, r.Operator = m[1], SelectorOperator(m[2])
+		for _, value := range strings.Split(m[3], ",") {
+			r.Values = append(r.Values, strings.TrimSpace(value))
+		}
+	} else if strings.HasPrefix(s, "!") && !strings.Contains(s, "=") {
+		r.Key, r.Operator = strings.TrimSpace(s[1:]), SelectorDoesNotExist
+	} else if i := strings.Index(s, "!="); i >= 0 {
+		r.Key, r.Operator, r.Values = s[:i], SelectorNotEquals, []string{s[i+2:]}
+	} else if i := strings.Index(s, "=="); i >= 0 {
+		r.Key, r.Operator, r.Values = s[:i], SelectorEquals, []string{s[i+2:]}
+	} else if i := strings.Index(s, "="); i >= 0 {
+		r.Key, r.Operator, r.Values = s[:i], SelectorEquals, []string{s[i+1:]}
+	} else {
+		r.Key, r.Operator = s, SelectorExists
+	}
+
+	r.Key = strings.TrimSpace(r.Key)
+	if !labelPattern.MatchString(r.Key) {
+		return nil, errors.Errorf("invalid label key in '%s'", s)
+	}
+	for i, value := range r.Values {
+		r.Values[i] = strings.TrimSpace(value)
+		if !labelValuePattern.MatchString(r.Values[i]) {
+			return nil, errors.Errorf("invalid label value in '%s'", s)
+		}
+	}
+	return r, nil
+}
+
+// SelectorFromLabels returns a selector requiring all the labels
+func SelectorFromLabels(labels map[string]string) Selector {
+	selector := Selector{}
+	for k, v := range labels {
+		selector = append(selector, Requirement{Key: k, Operator: SelectorEquals, Values: []string{v}})
+	}
+	// keep String stable
+	sort.Slice(selector, func(i, j int) bool { return selector[i].Key < selector[j].Key })
+	return selector
+}
+
+// Empty reports whether the selector matches everything
+func (s Selector) Empty() bool {
+	return len(s) == 0
+}
+
+// Matches reports whether the labels fulfil all requirements
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case SelectorExists:
+		return ok
+	case SelectorDoesNotExist:
+		return !ok
+	case SelectorEquals, SelectorIn:
+		return ok && r.hasValue(value)
+	case SelectorNotEquals, SelectorNotIn:
+		return !ok || !r.hasValue(value)
+	}
+	return false
+}
+
+func (r *Requirement) hasValue(value string) bool {
+	for _, v := range r.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Selector) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		switch r.Operator {
+		case SelectorExists:
+			parts[i] = r.Key
+		case SelectorDoesNotExist:
+			parts[i] = "!" + r.Key
+		case SelectorIn, SelectorNotIn:
+			parts[i] = r.Key + " " + string(r.Operator) + " (" + strings.Join(r.Values, ",") + ")"
+		default:
+			parts[i] = r.Key + string(r.Operator) + r.Values[0]
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("role in (web, api),dc!=ams1, tier==frontend,gpu,!legacy")
+	assert.Nil(t, err)
+	assert.Equal(t, "role in (web,api),dc!=ams1,tier=frontend,gpu,!legacy", selector.String())
+
+	assert.True(t, selector.Matches(map[string]string{"role": "api", "dc": "fra1", "tier": "frontend", "gpu": ""}))
+	// != and notin match missing labels
+	assert.True(t, selector.Matches(map[string]string{"role": "web", "tier": "frontend", "gpu": "true"}))
+	assert.False(t, selector.Matches(map[string]string{"role": "db", "tier": "frontend", "gpu": "true"}))
+	assert.False(t, selector.Matches(map[string]string{"role": "web", "dc": "ams1", "tier": "frontend", "gpu": "true"}))
+	assert.False(t, selector.Matches(map[string]string{"role": "web", "tier": "frontend"}))
+	assert.False(t, selector.Matches(map[string]string{"role": "web", "tier": "frontend", "gpu": "true", "legacy": "yes"}))
+
+	notIn, err := ParseSelector("dc notin (ams1,ams2)")
+	assert.Nil(t, err)
+	assert.True(t, notIn.Matches(nil))
+	assert.False(t, notIn.Matches(map[string]string{"dc": "ams2"}))
+
+	empty, err := ParseSelector("")
+	assert.Nil(t, err)
+	assert.True(t, empty.Empty())
+	assert.True(t, empty.Matches(nil))
+
+	for _, invalid := range []string{"role in web", "=web", "role=we b", "ro le", "role in (web,a$i)"} {
+		_, err := ParseSelector(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
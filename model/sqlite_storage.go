@@ -0,0 +1,133 @@
+//go:build sqlite
+// +build sqlite
+
+package model
+
+import (
+	"database/sql"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+
+	// registers the sqlite3 database/sql driver, needs cgo
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS records (
+	kind  TEXT NOT NULL,
+	key   BLOB NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (kind, key)
+)`
+
+func init() {
+	storageDrivers["sqlite"] = openSQLiteStorage
+}
+
+// openSQLiteStorage keeps the instances and the environment in the
+// SQLite file dsn
+func openSQLiteStorage(db *bolt.DB, dsn string) (*Storage, error) {
+	if dsn == "" {
+		return nil, errors.New("the sqlite driver needs db.dsn, the path of the database file")
+	}
+	sqlDB, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// writers would fail with "database is locked" otherwise
+	sqlDB.SetMaxOpenConns(1)
+	if _, err := sqlDB.Exec(sqliteSchema); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	store := &sqliteStore{sqlDB}
+	return &Storage{
+		Instances:   NewRecordInstanceRepository(store, db),
+		Environment: NewRecordEnvironmentRepository(store),
+		close:       sqlDB.Close,
+	}, nil
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteStore) View(fn func(tx recordTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(&sqliteTx{tx})
+}
+
+func (s *sqliteStore) Update(fn func(tx recordTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqliteTx{tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+func (t *sqliteTx) Get(kind string, key []byte) ([]byte, error) {
+	var value []byte
+	err := t.tx.QueryRow(`SELECT value FROM records WHERE kind = ? AND key = ?`, kind, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (t *sqliteTx) Put(kind string, key, value []byte) error {
+	_, err := t.tx.Exec(`INSERT OR REPLACE INTO records (kind, key, value) VALUES (?, ?, ?)`, kind, key, value)
+	return err
+}
+
+func (t *sqliteTx) Delete(kind string, key []byte) error {
+	_, err := t.tx.Exec(`DELETE FROM records WHERE kind = ? AND key = ?`, kind, key)
+	return err
+}
+
+// ForEach reads the records before visiting them, fn may write to the
+// transaction
+func (t *sqliteTx) ForEach(kind string, prefix []byte, fn func(key, value []byte) error) error {
+	var rows *sql.Rows
+	var err error
+	if len(prefix) == 0 {
+		// an empty blob would be bound as NULL
+		rows, err = t.tx.Query(`SELECT key, value FROM records WHERE kind = ? ORDER BY key`, kind)
+	} else {
+		rows, err = t.tx.Query(`SELECT key, value FROM records
+			WHERE kind = ? AND substr(key, 1, ?) = ? ORDER BY key`, kind, len(prefix), prefix)
+	}
+	if err != nil {
+		return err
+	}
+	var keys, values [][]byte
+	for rows.Next() {
+		var k, v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		keys, values = append(keys, k), append(values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range keys {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
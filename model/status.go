@@ -0,0 +1,98 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InstanceStatus is the provisioning state of an instance
+type InstanceStatus string
+
+const (
+	StatusPending         InstanceStatus = "pending"
+	StatusArmed           InstanceStatus = "armed"
+	StatusMetaDataFetched InstanceStatus = "metadata-fetched"
+	StatusUserDataFetched InstanceStatus = "userdata-fetched"
+	StatusBooted          InstanceStatus = "booted"
+	StatusFinished        InstanceStatus = "finished"
+	StatusFailed          InstanceStatus = "failed"
+)
+
+// maxStatusHistory caps the transitions kept per instance
+const maxStatusHistory = 50
+
+var ErrIllegalTransition = errors.New("illegal status transition")
+
+// statusTransitions lists the states each state may move to. Arming is
+// allowed from every state to provision an instance again.
+var statusTransitions = map[InstanceStatus][]InstanceStatus{
+	StatusPending:         {StatusMetaDataFetched, StatusUserDataFetched, StatusFailed},
+	StatusArmed:           {StatusMetaDataFetched, StatusUserDataFetched, StatusFailed},
+	StatusMetaDataFetched: {StatusUserDataFetched, StatusBooted, StatusFinished, StatusFailed},
+	StatusUserDataFetched: {StatusBooted, StatusFinished, StatusFailed},
+	StatusBooted:          {StatusFinished, StatusFailed},
+	StatusFinished:        {},
+	StatusFailed:          {},
+}
+
+// StatusTransition records when an instance entered a status
+type StatusTransition struct {
+	Status InstanceStatus `json:"status"`
+	At     time.Time      `json:"at"`
+}
+
+// Valid reports whether s is a known status
+func (s InstanceStatus) Valid() bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// CanTransition reports whether an instance may move from s to next
+func (s InstanceStatus) CanTransition(next InstanceStatus) bool {
+	if next == StatusArmed {
+		return true
+	}
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentStatus returns the status, treating instances stored before
+// statuses existed as pending
+func (p *Instance) CurrentStatus() InstanceStatus {
+	if p.Status == "" {
+		return StatusPending
+	}
+	return p.Status
+}
+
+// Transition moves the instance to the next status, returning
+// ErrIllegalTransition when the state machine doesn't allow it
+func (p *Instance) Transition(next InstanceStatus, at time.Time) error {
+	if !p.CurrentStatus().CanTransition(next) {
+		return errors.Wrapf(ErrIllegalTransition, "%s to %s", p.CurrentStatus(), next)
+	}
+	p.setStatus(next, at)
+	return nil
+}
+
+// advance moves the instance forward when allowed and ignores the
+// transition otherwise, e.g. when a finished instance fetches its
+// metadata again after a reboot
+func (p *Instance) advance(next InstanceStatus, at time.Time) {
+	if p.CurrentStatus() != next && p.CurrentStatus().CanTransition(next) {
+		p.setStatus(next, at)
+	}
+}
+
+func (p *Instance) setStatus(status InstanceStatus, at time.Time) {
+	p.Status = status
+	p.StatusHistory = append(p.StatusHistory, StatusTransition{Status: status, At: at})
+	if len(p.StatusHistory) > maxStatusHistory {
+		p.StatusHistory = p.StatusHistory[len(p.StatusHistory)-maxStatusHistory:]
+	}
+}
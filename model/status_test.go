@@ -0,0 +1,40 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceStatusTransitions(t *testing.T) {
+	item := &Instance{}
+	assert.Equal(t, StatusPending, item.CurrentStatus())
+
+	now := time.Now()
+	item.advance(StatusMetaDataFetched, now)
+	item.advance(StatusUserDataFetched, now)
+	assert.Nil(t, item.Transition(StatusBooted, now))
+
+	err := item.Transition(StatusUserDataFetched, now)
+	assert.Equal(t, ErrIllegalTransition, errors.Cause(err))
+
+	assert.Nil(t, item.Transition(StatusFinished, now))
+
+	// a reboot fetches the metadata again without changing the status
+	item.advance(StatusMetaDataFetched, now)
+	assert.Equal(t, StatusFinished, item.Status)
+
+	assert.Nil(t, item.Transition(StatusArmed, now))
+	assert.Equal(t, []InstanceStatus{StatusMetaDataFetched, StatusUserDataFetched, StatusBooted, StatusFinished, StatusArmed},
+		statuses(item.StatusHistory))
+}
+
+func statuses(history []StatusTransition) []InstanceStatus {
+	result := []InstanceStatus{}
+	for _, t := range history {
+		result = append(result, t.Status)
+	}
+	return result
+}
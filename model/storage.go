@@ -0,0 +1,80 @@
+package model
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Storage holds the repositories of a storage driver. Tokens, the audit
+// log, events and fetches are kept in the Bolt database regardless.
+type Storage struct {
+	Instances   InstanceRepository
+	Environment EnvironmentRepository
+	// close releases what the driver opened besides the Bolt database
+	close func() error
+}
+
+// Close releases the storage
+func (s *Storage) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// storageDriver opens a storage. db is the Bolt database, dsn the data
+// source of the driver if it has its own.
+type storageDriver func(db *bolt.DB, dsn string) (*Storage, error)
+
+// storageDrivers by name, drivers behind build tags add themselves
+var storageDrivers = map[string]storageDriver{
+	"bolt":   openBoltStorage,
+	"memory": openMemoryStorage,
+}
+
+// DefaultStorageDriver keeps everything in the Bolt database
+const DefaultStorageDriver = "bolt"
+
+// OpenStorage opens the storage of the named driver, bolt if empty
+func OpenStorage(driver string, db *bolt.DB, dsn string) (*Storage, error) {
+	if driver == "" {
+		driver = DefaultStorageDriver
+	}
+	open, ok := storageDrivers[driver]
+	if !ok {
+		return nil, errors.Errorf("unknown storage driver '%s', expected one of %s", driver, strings.Join(StorageDrivers(), ", "))
+	}
+	storage, err := open(db, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s storage", driver)
+	}
+	return storage, nil
+}
+
+// StorageDrivers lists the drivers built in
+func StorageDrivers() []string {
+	var names []string
+	for name := range storageDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func openBoltStorage(db *bolt.DB, dsn string) (*Storage, error) {
+	return &Storage{
+		Instances:   NewInstanceRepository(db),
+		Environment: NewEnvironmentRepository(db),
+	}, nil
+}
+
+func openMemoryStorage(db *bolt.DB, dsn string) (*Storage, error) {
+	store := newMemoryStore()
+	return &Storage{
+		Instances:   NewRecordInstanceRepository(store, db),
+		Environment: NewRecordEnvironmentRepository(store),
+	}, nil
+}
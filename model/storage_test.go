@@ -0,0 +1,252 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestStorageConformance runs the same checks against every storage
+// driver built in, run with -tags sqlite to include SQLite
+func TestStorageConformance(t *testing.T) {
+	for _, driver := range StorageDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, cleanup := openTestDB(t)
+			defer cleanup()
+			dir, err := ioutil.TempDir("", "cloud-initer")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			storage, err := OpenStorage(driver, db, filepath.Join(dir, "test.db"))
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer storage.Close()
+
+			t.Run("instances", func(t *testing.T) { testInstanceStorage(t, storage.Instances) })
+			t.Run("batch", func(t *testing.T) { testBatchStorage(t, storage.Instances) })
+			t.Run("order", func(t *testing.T) { testInstanceOrder(t, storage.Instances) })
+			t.Run("environment", func(t *testing.T) { testEnvironmentStorage(t, storage.Environment) })
+			t.Run("purge", func(t *testing.T) { testPurgeHistory(t, db, storage.Instances) })
+		})
+	}
+}
+
+func testInstanceStorage(t *testing.T, repo InstanceRepository) {
+	web1, err := repo.Save(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, web1.ID)
+	assert.Equal(t, uint64(1), web1.Revision)
+	id := web1.ID.Hex()
+	_, err = repo.Save(&Instance{Name: "web2", IPAddress: "10.0.0.2", MACAddress: "00:00:00:00:00:02"})
+	assert.Nil(t, err)
+
+	item, err := repo.FindOne(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "web1", item.Name)
+	item, err = repo.FindOne("0123456789abcdef01234567")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+	item, err = repo.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, id, item.ID.Hex())
+	item, err = repo.FindByMACAddress("00-00-00-00-00-01")
+	assert.Nil(t, err)
+	assert.Equal(t, id, item.ID.Hex())
+
+	items, total, err := repo.FindPage(&InstanceQuery{Sort: SortByName, Descending: true, Page: 1, PageSize: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "web2", items[0].Name)
+
+	// saves are checked against the stored revision
+	web1.IPAddress = "10.0.0.9"
+	_, err = repo.Save(web1)
+	assert.Nil(t, err)
+	web1.Revision = 1
+	_, err = repo.Save(web1)
+	assert.Equal(t, ErrRevisionConflict, err)
+	item, err = repo.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+	revisions, err := repo.FindRevisions(id)
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	item, err = repo.FindRevision(id, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", item.IPAddress)
+	_, err = repo.FindRevision(id, 3)
+	assert.Equal(t, ErrRevisionNotFound, err)
+
+	// Modify doesn't add a revision
+	item, err = repo.Modify(id, func(item *Instance) error {
+		item.UserDataFetches++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), item.Revision)
+	_, err = repo.Modify("0123456789abcdef01234567", func(item *Instance) error { return nil })
+	assert.Equal(t, ErrInstanceNotFound, err)
+
+	// the trash
+	assert.Equal(t, ErrRevisionConflict, repo.Delete(id, 1, "admin"))
+	assert.Nil(t, repo.Delete(id, 2, "admin"))
+	item, err = repo.FindOne(id)
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+	item, err = repo.FindByIPAddress("10.0.0.9")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+	trashed, err := repo.FindTrashed(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "admin", trashed.DeletedBy)
+	item, err = repo.Undelete(id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, item.UserDataFetches)
+	_, err = repo.FindTrashed(id)
+	assert.Equal(t, ErrInstanceNotFound, err)
+
+	assert.Nil(t, repo.Delete(id, 0, "admin"))
+	purged, err := repo.PurgeTrash(time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged)
+	purged, err = repo.PurgeTrash(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	trash, err := repo.FindTrash()
+	assert.Nil(t, err)
+	assert.Empty(t, trash)
+	revisions, err = repo.FindRevisions(id)
+	assert.Nil(t, err)
+	assert.Empty(t, revisions)
+	assert.Equal(t, ErrInstanceNotFound, repo.Purge(id))
+}
+
+func testBatchStorage(t *testing.T, repo InstanceRepository) {
+	failed := errors.New("failed")
+	err := repo.Batch(func(batch InstanceBatch) error {
+		item, err := batch.Save(&Instance{Name: "db1", IPAddress: "10.0.1.1", MACAddress: "00:00:00:00:01:01"})
+		assert.Nil(t, err)
+		found, err := batch.FindByIPAddress("10.0.1.1")
+		assert.Nil(t, err)
+		assert.Equal(t, item.ID, found.ID)
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	item, err := repo.FindByIPAddress("10.0.1.1")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+
+	var id string
+	err = repo.Batch(func(batch InstanceBatch) error {
+		item, err := batch.Save(&Instance{Name: "db1", IPAddress: "10.0.1.1", MACAddress: "00:00:00:00:01:01"})
+		id = item.ID.Hex()
+		return err
+	})
+	assert.Nil(t, err)
+	err = repo.Batch(func(batch InstanceBatch) error {
+		return batch.Delete(id, 0, "")
+	})
+	assert.Nil(t, err)
+	err = repo.Batch(func(batch InstanceBatch) error {
+		inTrash, err := batch.InTrash(id)
+		assert.True(t, inTrash)
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+// instances are listed by creation time, not by their ID, which may be
+// supplied
+func testInstanceOrder(t *testing.T, repo InstanceRepository) {
+	older, err := repo.Save(&Instance{Name: "order-older", IPAddress: "10.0.2.1"})
+	assert.Nil(t, err)
+	newer := &Instance{
+		ID:        bson.NewObjectIdWithTime(time.Now().Add(-24 * time.Hour)),
+		Name:      "order-newer",
+		IPAddress: "10.0.2.2",
+		CreatedAt: time.Now().Add(time.Second),
+	}
+	err = repo.Batch(func(batch InstanceBatch) error {
+		_, err := batch.Save(newer)
+		return err
+	})
+	assert.Nil(t, err)
+
+	items, total, err := repo.FindPage(&InstanceQuery{NamePrefix: "order-"})
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, total) {
+		assert.Equal(t, older.ID.Hex(), items[0].ID.Hex())
+		assert.Equal(t, newer.ID.Hex(), items[1].ID.Hex())
+	}
+	items, _, err = repo.FindPage(&InstanceQuery{NamePrefix: "order-", Descending: true})
+	assert.Nil(t, err)
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, newer.ID.Hex(), items[0].ID.Hex())
+	}
+}
+
+// purging an instance drops its events and fetches, which are kept in
+// the Bolt database with every driver
+func testPurgeHistory(t *testing.T, db *bolt.DB, repo InstanceRepository) {
+	events := NewEventRepository(db)
+	fetches := NewFetchRepository(db)
+	var ids []string
+	for i, name := range []string{"app1", "app2"} {
+		item, err := repo.Save(&Instance{Name: name, IPAddress: fmt.Sprintf("10.0.2.%d", i+1), MACAddress: fmt.Sprintf("00:00:00:00:02:0%d", i+1)})
+		assert.Nil(t, err)
+		id := item.ID.Hex()
+		ids = append(ids, id)
+		assert.Nil(t, events.Append(id, &Event{Name: "init", Timestamp: time.Now()}, 0))
+		assert.Nil(t, fetches.Append(id, &Fetch{Timestamp: time.Now()}, time.Now().Add(-time.Hour)))
+		found, err := fetches.FindByInstance(id)
+		assert.Nil(t, err)
+		assert.Len(t, found, 1)
+		assert.Nil(t, repo.Delete(id, 0, "admin"))
+	}
+
+	assert.Nil(t, repo.Purge(ids[0]))
+	_, err := repo.PurgeTrash(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	for _, id := range ids {
+		items, err := events.FindByInstance(id)
+		assert.Nil(t, err)
+		assert.Empty(t, items)
+		found, err := fetches.FindByInstance(id)
+		assert.Nil(t, err)
+		assert.Empty(t, found)
+	}
+}
+
+func testEnvironmentStorage(t *testing.T, repo EnvironmentRepository) {
+	item, err := repo.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), item.Revision)
+
+	item, err = repo.Save(&Environment{Config: "a: 1"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), item.Revision)
+	_, err = repo.Save(&Environment{Config: "a: 2", Revision: 1})
+	assert.Nil(t, err)
+	_, err = repo.Save(&Environment{Config: "a: 3", Revision: 1})
+	assert.Equal(t, ErrRevisionConflict, err)
+
+	item, err = repo.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "a: 2", item.Config)
+	revisions, err := repo.FindRevisions()
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	item, err = repo.FindRevision(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "a: 1", item.Config)
+	_, err = repo.FindRevision(3)
+	assert.Equal(t, ErrRevisionNotFound, err)
+}
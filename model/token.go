@@ -0,0 +1,140 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tokenPrefix makes API tokens easy to recognise in configs and logs
+const tokenPrefix = "cit_"
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenInvalid  = errors.New("invalid token")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
+// Token is an API token. Only the SHA-256 hash of the secret is stored.
+type Token struct {
+	ID        bson.ObjectId     `json:"id"`
+	Name      string            `json:"name"`
+	Role      Role              `json:"role"`
+	Scope     map[string]string `json:"scope,omitempty"`
+	Hash      string            `json:"-"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// Principal returns the identity authenticated by the token
+func (t *Token) Principal() *Principal {
+	role := t.Role
+	if role == "" {
+		// tokens created before roles existed had full access
+		role = RoleAdmin
+	}
+	return &Principal{Name: t.Name, Role: role, Scope: t.Scope}
+}
+
+// Expired reports whether the token has an expiry date in the past
+func (t *Token) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+type TokenService interface {
+	FindAll() ([]Token, error)
+	FindOne(id string) (*Token, error)
+	Create(item *Token, ttl time.Duration) (*Token, string, error)
+	Revoke(id string) error
+	Authenticate(secret string) (*Token, error)
+}
+
+type TokenServiceImpl struct {
+	Repository TokenRepository
+}
+
+func NewTokenService(repository TokenRepository) *TokenServiceImpl {
+	service := &TokenServiceImpl{
+		Repository: repository,
+	}
+	return service
+}
+
+func (c *TokenServiceImpl) FindAll() ([]Token, error) {
+	return c.Repository.FindAll()
+}
+
+func (c *TokenServiceImpl) FindOne(id string) (*Token, error) {
+	return c.Repository.FindOne(id)
+}
+
+// Create generates a new token. The returned secret is not stored
+// anywhere and can't be recovered later.
+func (c *TokenServiceImpl) Create(item *Token, ttl time.Duration) (*Token, string, error) {
+	if item.Name == "" {
+		return nil, "", errors.New("token name is required")
+	}
+	if !item.Role.Valid() {
+		return nil, "", errors.Errorf("unknown role '%s'", item.Role)
+	}
+	secret, err := newTokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	item.ID = ""
+	item.Hash = hashTokenSecret(secret)
+	if ttl > 0 {
+		item.ExpiresAt = time.Now().Add(ttl)
+	}
+	item, err = c.Repository.Save(item)
+	if err != nil {
+		return nil, "", err
+	}
+	return item, secret, nil
+}
+
+func (c *TokenServiceImpl) Revoke(id string) error {
+	item, err := c.Repository.FindOne(id)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return ErrTokenNotFound
+	}
+	return c.Repository.Delete(item)
+}
+
+func (c *TokenServiceImpl) Authenticate(secret string) (*Token, error) {
+	if secret == "" {
+		return nil, ErrTokenInvalid
+	}
+	item, err := c.Repository.FindByHash(hashTokenSecret(secret))
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrTokenInvalid
+	}
+	if item.Expired() {
+		return nil, ErrTokenExpired
+	}
+	return item, nil
+}
+
+func newTokenSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "generating token")
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
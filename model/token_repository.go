@@ -0,0 +1,123 @@
+package model
+
+import (
+	"time"
+
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// tokens are keyed by the hash of their secret, so a lookup during
+// authentication is a single Get
+var tokenBucket = []byte("tokens")
+
+type TokenRepository interface {
+	FindAll() ([]Token, error)
+	FindOne(id string) (*Token, error)
+	FindByHash(hash string) (*Token, error)
+	Save(item *Token) (*Token, error)
+	Delete(item *Token) error
+}
+
+type BoltTokenRepository struct {
+	db *bolt.DB
+}
+
+func NewTokenRepository(db *bolt.DB) *BoltTokenRepository {
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokenBucket)
+		return err
+	})
+	return &BoltTokenRepository{db}
+}
+
+func (r *BoltTokenRepository) FindAll() ([]Token, error) {
+	items := []Token{}
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		return b.ForEach(func(k, v []byte) error {
+			item, err := decodeToken(k, v)
+			if err != nil {
+				return err
+			}
+			items = append(items, *item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *BoltTokenRepository) FindOne(id string) (*Token, error) {
+	items, err := r.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.ID.Hex() == id {
+			return &item, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *BoltTokenRepository) FindByHash(hash string) (*Token, error) {
+	var item *Token
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b := tx.Bucket(tokenBucket)
+		k := []byte(hash)
+		itemData := b.Get(k)
+		if len(itemData) == 0 {
+			return nil
+		}
+		item, err = decodeToken(k, itemData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *BoltTokenRepository) Save(item *Token) (*Token, error) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		if item.ID == "" {
+			item.ID = bson.NewObjectId()
+			item.CreatedAt = time.Now()
+		}
+		enc, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(item.Hash), enc)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (r *BoltTokenRepository) Delete(item *Token) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		return b.Delete([]byte(item.Hash))
+	})
+}
+
+func decodeToken(key, data []byte) (*Token, error) {
+	var item *Token
+	err := json.Unmarshal(data, &item)
+	if err != nil {
+		return nil, err
+	}
+	item.Hash = string(key)
+	return item, nil
+}
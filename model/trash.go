@@ -0,0 +1,63 @@
+package model
+
+import (
+	"time"
+)
+
+// TrashedInstance is a deleted instance kept for restoring until it's
+// purged
+type TrashedInstance struct {
+	Instance  Instance  `json:"instance"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+}
+
+func (c *InstanceServiceImpl) FindTrash() ([]TrashedInstance, error) {
+	return c.Repository.FindTrash()
+}
+
+func (c *InstanceServiceImpl) FindTrashed(id string) (*TrashedInstance, error) {
+	return c.Repository.FindTrashed(id)
+}
+
+// Undelete moves an instance from the trash back to the instances. It
+// fails with validator.ValidationErrors when another instance took its IP
+// or MAC address in the meantime, checked in the same transaction.
+func (c *InstanceServiceImpl) Undelete(id string, actor *Actor) (*Instance, error) {
+	var item *Instance
+	err := c.Repository.Batch(func(batch InstanceBatch) error {
+		trashed, err := batch.FindTrashed(id)
+		if err != nil {
+			return err
+		}
+		if err := c.validateInBatch(batch, &trashed.Instance); err != nil {
+			return err
+		}
+		item, err = batch.Undelete(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.audit(actor, AuditUndelete, nil, item)
+	return item, nil
+}
+
+// Purge removes an instance from the trash along with its revisions
+func (c *InstanceServiceImpl) Purge(id string, actor *Actor) error {
+	trashed, err := c.Repository.FindTrashed(id)
+	if err != nil {
+		return err
+	}
+	if err := c.Repository.Purge(id); err != nil {
+		return err
+	}
+	c.audit(actor, AuditPurge, &trashed.Instance, nil)
+	return nil
+}
+
+// PurgeTrash removes all instances deleted before the given time and
+// returns how many were purged
+func (c *InstanceServiceImpl) PurgeTrash(before time.Time) (int, error) {
+	return c.Repository.PurgeTrash(before)
+}
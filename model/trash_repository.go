@@ -0,0 +1,150 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// deleted instances are moved here, keyed by ID, until they're purged
+var instanceTrashBucket = []byte("instance-trash")
+
+func (r *BoltInstanceRepository) FindTrash() ([]TrashedInstance, error) {
+	items := []TrashedInstance{}
+
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(instanceTrashBucket).ForEach(func(k, v []byte) error {
+			var item TrashedInstance
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *BoltInstanceRepository) FindTrashed(id string) (*TrashedInstance, error) {
+	var item *TrashedInstance
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		item, err = getTrashed(tx, []byte(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *BoltInstanceRepository) Undelete(id string) (*Instance, error) {
+	var item *Instance
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		item, err = undeleteInstance(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func undeleteInstance(tx *bolt.Tx, id string) (*Instance, error) {
+	k := []byte(id)
+	trashed, err := getTrashed(tx, k)
+	if err != nil {
+		return nil, err
+	}
+	item := &trashed.Instance
+	enc, err := item.encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(instanceBucket).Put(k, enc); err != nil {
+		return nil, err
+	}
+	if err := updateIndexes(tx, nil, item); err != nil {
+		return nil, err
+	}
+	return item, tx.Bucket(instanceTrashBucket).Delete(k)
+}
+
+func (r *BoltInstanceRepository) Purge(id string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(id)
+		if _, err := getTrashed(tx, k); err != nil {
+			return err
+		}
+		return purge(tx, k)
+	})
+}
+
+func (r *BoltInstanceRepository) PurgeTrash(before time.Time) (int, error) {
+	purged := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		var old [][]byte
+		err := tx.Bucket(instanceTrashBucket).ForEach(func(k, v []byte) error {
+			var item TrashedInstance
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if item.DeletedAt.Before(before) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := purge(tx, k); err != nil {
+				return err
+			}
+		}
+		purged = len(old)
+		return nil
+	})
+	return purged, err
+}
+
+func getTrashed(tx *bolt.Tx, k []byte) (*TrashedInstance, error) {
+	itemData := tx.Bucket(instanceTrashBucket).Get(k)
+	if len(itemData) == 0 {
+		return nil, ErrInstanceNotFound
+	}
+	var item TrashedInstance
+	if err := json.Unmarshal(itemData, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// purge removes a trashed instance with its revisions, events and
+// fetches
+func purge(tx *bolt.Tx, k []byte) error {
+	if err := tx.Bucket(instanceTrashBucket).Delete(k); err != nil {
+		return err
+	}
+	return deleteHistory(tx, k, instanceRevisionBucket, eventBucket, fetchBucket)
+}
+
+// deleteHistory removes the nested buckets an instance has in the
+// buckets given
+func deleteHistory(tx *bolt.Tx, k []byte, names ...[]byte) error {
+	for _, name := range names {
+		b := tx.Bucket(name)
+		if b == nil || b.Bucket(k) == nil {
+			continue
+		}
+		if err := b.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
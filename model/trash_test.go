@@ -0,0 +1,37 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+func TestUndeleteChecksAddresses(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	service := NewInstanceService(NewInstanceRepository(db), nil, validator.New())
+
+	web1, err := service.Create(&Instance{Name: "web1", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:01"}, nil)
+	assert.Nil(t, err)
+	id := web1.ID.Hex()
+	assert.Nil(t, service.Delete(id, 0, nil))
+	web2, err := service.Create(&Instance{Name: "web2", IPAddress: "10.0.0.1", MACAddress: "00:00:00:00:00:02"}, nil)
+	assert.Nil(t, err)
+
+	// the address is taken, web1 stays in the trash
+	_, err = service.Undelete(id, nil)
+	assert.IsType(t, validator.ValidationErrors{}, err)
+	_, err = service.FindTrashed(id)
+	assert.Nil(t, err)
+
+	web2.IPAddress = "10.0.0.2"
+	_, err = service.Update(web2.ID.Hex(), web2, nil)
+	assert.Nil(t, err)
+	item, err := service.Undelete(id, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "web1", item.Name)
+	item, err = service.Repository.FindByIPAddress("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, id, item.ID.Hex())
+}